@@ -0,0 +1,115 @@
+package opa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+
+	"github.com/open-policy-agent/opa/sdk"
+	"github.com/open-policy-agent/opa/server/types"
+)
+
+const (
+	// batchConcurrency is the number of decisions of a batch evaluated at
+	// the same time.
+	batchConcurrency = 8
+
+	// batchAttempts is how many times a batch is evaluated when a bundle is
+	// activated part way through evaluating it.
+	batchAttempts = 3
+)
+
+// ErrRevisionChanged is returned when the bundles of an OPA changed during
+// each attempt to evaluate a batch.
+var ErrRevisionChanged = errors.New("bundle revision changed during batch evaluation")
+
+// BatchResult is the outcome of a single decision of a batch. Err is set
+// when the decision could not be evaluated, including when it is undefined.
+type BatchResult struct {
+	Result *sdk.DecisionResult
+	Err    error
+}
+
+// BatchDecision evaluates decisions concurrently on the OPA with the given
+// ref. All results are evaluated against the same bundle revisions, the batch
+// is evaluated again when a bundle is activated part way through.
+func (m *Manager) BatchDecision(
+	ctx context.Context,
+	ref string,
+	decisions []sdk.DecisionOptions,
+) ([]BatchResult, error) {
+	// the instance is looked up once so that an Update does not swap it
+	// during the batch
+	inst, err := m.readyInstance(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < batchAttempts; attempt++ {
+		results := inst.batchDecision(ctx, decisions)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if consistentProvenance(results) {
+			return results, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s: %w", ref, ErrRevisionChanged)
+}
+
+func (i *instance) batchDecision(ctx context.Context, decisions []sdk.DecisionOptions) []BatchResult {
+	results := make([]BatchResult, len(decisions))
+
+	work := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(batchConcurrency, len(decisions)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for n := range work {
+				results[n].Result, results[n].Err = i.decision(ctx, decisions[n])
+			}
+		}()
+	}
+
+	for n := range decisions {
+		work <- n
+	}
+	close(work)
+
+	wg.Wait()
+
+	return results
+}
+
+// consistentProvenance returns true if all results were evaluated against
+// the same bundle revisions.
+func consistentProvenance(results []BatchResult) bool {
+	var first map[string]types.ProvenanceBundleV1
+	seen := false
+
+	for _, r := range results {
+		if r.Result == nil {
+			continue
+		}
+
+		if !seen {
+			first = r.Result.Provenance.Bundles
+			seen = true
+			continue
+		}
+
+		if !maps.Equal(first, r.Result.Provenance.Bundles) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,218 @@
+package opa
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/open-policy-agent/opa/sdk"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// CacheStats are the statistics of the decision cache of an OPA.
+type CacheStats struct {
+	Size      int
+	Capacity  int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+
+	// Invalidations counts the times the cache was cleared because the
+	// store of the OPA was written to, such as when a bundle is activated.
+	Invalidations uint64
+}
+
+// HitRatio returns the proportion of lookups which were hits.
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// decisionCache is an LRU cache of decisions. It is cleared each time the
+// store of the instance is written to, which happens while the write is
+// committed so that no decision evaluated against previous data is served
+// once the write is visible.
+type decisionCache struct {
+	lock sync.Mutex
+
+	capacity int
+	entries  map[string]*list.Element
+	// order holds the keys of the entries, the most recently used first
+	order *list.List
+
+	// generation is incremented on each invalidation, decisions evaluated
+	// during an earlier generation are not added
+	generation uint64
+
+	stats CacheStats
+}
+
+type cacheEntry struct {
+	key    string
+	result *sdk.DecisionResult
+	err    error
+}
+
+func newDecisionCache(capacity int) *decisionCache {
+	return &decisionCache{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// cacheKey returns the key of the decision for options, ok is false for
+// decisions which cannot be cached as they depend on more than the path and
+// input.
+func cacheKey(options sdk.DecisionOptions) (string, bool, error) {
+	if !options.Now.IsZero() || options.NDBCache != nil || options.Tracer != nil ||
+		options.Metrics != nil || options.Profiler != nil || options.Instrument ||
+		options.DecisionID != "" {
+		return "", false, nil
+	}
+
+	// maps are encoded with sorted keys, so equal inputs have equal hashes
+	input, err := json.Marshal(options.Input)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to encode input: %w", err)
+	}
+
+	hash := sha256.Sum256(input)
+
+	return options.Path + "\x00" + hex.EncodeToString(hash[:]), true, nil
+}
+
+// get returns the cached decision for key along with the generation it
+// must be added under if it is not cached.
+func (c *decisionCache) get(key string) (*cacheEntry, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, c.generation
+	}
+
+	c.stats.Hits++
+	c.order.MoveToFront(e)
+
+	return e.Value.(*cacheEntry), c.generation
+}
+
+// add caches a decision evaluated during generation, it is dropped if the
+// cache has been invalidated since.
+func (c *decisionCache) add(generation uint64, entry *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if e, ok := c.entries[entry.key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[entry.key] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+func (c *decisionCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	c.stats.Invalidations++
+
+	clear(c.entries)
+	c.order.Init()
+}
+
+func (c *decisionCache) getStats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s := c.stats
+	s.Size = c.order.Len()
+	s.Capacity = c.capacity
+
+	return s
+}
+
+// decision returns the cached decision for options, evaluating it with
+// evaluate and caching it when it is not cached. Undefined decisions are
+// cached, other errors are not. hit is true when the decision was served
+// from the cache, in which case it was not seen by the decision log plugin.
+// The cache holds its own copy of results so that callers may give the
+// result they get the ID of their own decision.
+func (c *decisionCache) decision(
+	options sdk.DecisionOptions,
+	evaluate func() (*sdk.DecisionResult, error),
+) (result *sdk.DecisionResult, hit bool, err error) {
+	key, ok, err := cacheKey(options)
+	if err != nil || !ok {
+		result, err = evaluate()
+		return result, false, err
+	}
+
+	entry, generation := c.get(key)
+	if entry != nil {
+		if entry.result != nil {
+			r := *entry.result
+			result = &r
+		}
+
+		return result, true, entry.err
+	}
+
+	result, err = evaluate()
+	if err == nil || sdk.IsUndefinedErr(err) {
+		entry = &cacheEntry{key: key, err: err}
+		if result != nil {
+			r := *result
+			entry.result = &r
+		}
+
+		c.add(generation, entry)
+	}
+
+	return result, false, err
+}
+
+// registerInvalidation invalidates the cache whenever store is written to.
+// The trigger runs as writes are committed, before they are visible to
+// decisions.
+func (c *decisionCache) registerInvalidation(ctx context.Context, store storage.Store) error {
+	txn, err := store.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Register(ctx, txn, storage.TriggerConfig{
+		OnCommit: func(context.Context, storage.Transaction, storage.TriggerEvent) {
+			c.invalidate()
+		},
+	})
+	if err != nil {
+		store.Abort(ctx, txn)
+		return err
+	}
+
+	return store.Commit(ctx, txn)
+}
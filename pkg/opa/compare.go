@@ -0,0 +1,96 @@
+package opa
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/open-policy-agent/opa/sdk"
+)
+
+// Comparison is the outcome of evaluating a decision on one of the OPAs of
+// a comparison.
+type Comparison struct {
+	Ref string
+
+	// Result is nil when the decision could not be evaluated, Err is set
+	// when the decision failed or is undefined.
+	Result *sdk.DecisionResult
+	Err    error
+
+	// Revisions are the revisions of the bundles the decision was evaluated
+	// against, keyed by bundle name.
+	Revisions map[string]string
+
+	// Differs is true when the result is not the same as the result of the
+	// first OPA which could evaluate the decision.
+	Differs bool
+}
+
+// Undefined returns true when the decision is undefined.
+func (c Comparison) Undefined() bool {
+	return sdk.IsUndefinedErr(c.Err)
+}
+
+// Compare evaluates the same decision on each of the OPAs with the given
+// refs, returning the comparisons in the order of refs.
+func (m *Manager) Compare(
+	ctx context.Context,
+	refs []string,
+	options sdk.DecisionOptions,
+) []Comparison {
+	comparisons := make([]Comparison, len(refs))
+
+	var wg sync.WaitGroup
+	for n, ref := range refs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := Comparison{Ref: ref}
+			c.Result, c.Err = m.Decision(ctx, ref, options)
+
+			if c.Result != nil {
+				c.Revisions = make(map[string]string, len(c.Result.Provenance.Bundles))
+				for name, b := range c.Result.Provenance.Bundles {
+					c.Revisions[name] = b.Revision
+				}
+			} else if status := m.Status(ref); status != nil {
+				c.Revisions = make(map[string]string, len(status.Bundles))
+				for _, b := range status.Bundles {
+					c.Revisions[b.Name] = b.ActiveRevision
+				}
+			}
+
+			comparisons[n] = c
+		}()
+	}
+	wg.Wait()
+
+	markDifferences(comparisons)
+
+	return comparisons
+}
+
+// markDifferences sets Differs on the comparisons with a different result to
+// the first comparison with a result. Comparisons which failed are not
+// compared, undefined decisions are compared as a distinct result.
+func markDifferences(comparisons []Comparison) {
+	var baseline *Comparison
+
+	for i := range comparisons {
+		c := &comparisons[i]
+
+		if c.Result == nil || (c.Err != nil && !c.Undefined()) {
+			continue
+		}
+
+		if baseline == nil {
+			baseline = c
+			continue
+		}
+
+		c.Differs = c.Undefined() != baseline.Undefined() ||
+			!reflect.DeepEqual(c.Result.Result, baseline.Result.Result)
+	}
+}
@@ -0,0 +1,310 @@
+package opa
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/metrics"
+	"github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/plugins/logs"
+	"github.com/open-policy-agent/opa/sdk"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+)
+
+// decisionLogPluginName is the name of the plugin receiving the events of
+// the decision logs plugin of each instance.
+const decisionLogPluginName = "demo_live_policy_update_decision_logs"
+
+// decisionLatencyMetric is the metric the SDK records the time taken to
+// evaluate a decision under.
+var decisionLatencyMetric = "timer_" + metrics.SDKDecisionEval + "_ns"
+
+// DecisionLog is a decision made by an OPA instance.
+type DecisionLog struct {
+	ID   string `json:"decision_id"`
+	Path string `json:"path,omitempty"`
+
+	// Query is set instead of Path for partial evaluations.
+	Query string `json:"query,omitempty"`
+
+	Input  interface{} `json:"input,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+
+	// Undefined is true when the decision had no result.
+	Undefined bool `json:"undefined,omitempty"`
+
+	// Error is set when the decision failed for a reason other than being
+	// undefined.
+	Error string `json:"error,omitempty"`
+
+	// Revisions maps the name of each bundle to the revision the decision
+	// was evaluated against.
+	Revisions map[string]string `json:"revisions,omitempty"`
+
+	Timestamp time.Time     `json:"timestamp"`
+	Latency   time.Duration `json:"latency_ns"`
+
+	// Cached is true when the decision was served from the decision cache
+	// rather than evaluated.
+	Cached bool `json:"cached,omitempty"`
+}
+
+// Revision lists the revisions of the decision as name@revision.
+func (d DecisionLog) Revision() string {
+	revisions := make([]string, 0, len(d.Revisions))
+	for name, revision := range d.Revisions {
+		revisions = append(revisions, name+"@"+revision)
+	}
+	sort.Strings(revisions)
+
+	return strings.Join(revisions, ", ")
+}
+
+func newDecisionLog(event logs.EventV1) DecisionLog {
+	d := DecisionLog{
+		ID:        event.DecisionID,
+		Path:      event.Path,
+		Query:     event.Query,
+		Timestamp: event.Timestamp,
+		Revisions: make(map[string]string, len(event.Bundles)),
+	}
+
+	if event.Input != nil {
+		d.Input = *event.Input
+	}
+
+	switch {
+	case event.MappedResult != nil:
+		d.Result = *event.MappedResult
+	case event.Result != nil:
+		d.Result = *event.Result
+	}
+
+	if event.Error != nil {
+		if sdk.IsUndefinedErr(event.Error) {
+			d.Undefined = true
+		} else {
+			d.Error = event.Error.Error()
+		}
+	}
+
+	for name, b := range event.Bundles {
+		d.Revisions[name] = b.Revision
+	}
+
+	if ns, ok := event.Metrics[decisionLatencyMetric].(int64); ok {
+		d.Latency = time.Duration(ns)
+	}
+
+	return d
+}
+
+// newCachedDecisionLog returns the log of a decision served from the cache
+// for options, started at start.
+func newCachedDecisionLog(options sdk.DecisionOptions, dr *sdk.DecisionResult, err error, start time.Time) DecisionLog {
+	d := DecisionLog{
+		ID:        options.DecisionID,
+		Path:      options.Path,
+		Input:     options.Input,
+		Timestamp: start,
+		Latency:   time.Since(start),
+		Cached:    true,
+	}
+
+	if d.ID == "" {
+		d.ID = newDecisionID()
+	}
+
+	if dr != nil {
+		d.Result = dr.Result
+
+		d.Revisions = make(map[string]string, len(dr.Provenance.Bundles))
+		for name, b := range dr.Provenance.Bundles {
+			d.Revisions[name] = b.Revision
+		}
+	}
+
+	if err != nil {
+		if sdk.IsUndefinedErr(err) {
+			d.Undefined = true
+		} else {
+			d.Error = err.Error()
+		}
+	}
+
+	return d
+}
+
+// newDecisionID returns a random ID for a decision which was not given one
+// by OPA.
+func newDecisionID() string {
+	bs := make([]byte, 16)
+	_, _ = rand.Read(bs)
+
+	return hex.EncodeToString(bs)
+}
+
+// decisionRecorder keeps the most recent decisions of an instance in a ring
+// buffer, and appends all decisions to a file when one is configured.
+type decisionRecorder struct {
+	lock sync.RWMutex
+
+	// decisions is the ring buffer, it grows as decisions are made until it
+	// holds size decisions. next is the index the next decision is written
+	// to and count is the number of decisions held
+	decisions []DecisionLog
+	size      int
+	next      int
+	count     int
+
+	file *os.File
+}
+
+func newDecisionRecorder(cfg config.DecisionLogs) (*decisionRecorder, error) {
+	cfg = cfg.WithDefaults()
+
+	r := &decisionRecorder{
+		size: cfg.Size,
+	}
+
+	if cfg.Path != "" {
+		var err error
+		r.file, err = os.OpenFile(cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open decision log file: %w", err)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *decisionRecorder) record(d DecisionLog) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.add(d)
+
+	if r.file == nil {
+		return
+	}
+
+	bs, err := json.Marshal(d)
+	if err != nil {
+		log.Printf("failed to encode decision %s: %s", d.ID, err)
+		return
+	}
+
+	_, err = r.file.Write(append(bs, '\n'))
+	if err != nil {
+		log.Printf("failed to write decision %s: %s", d.ID, err)
+	}
+}
+
+// add must be called with the lock held.
+func (r *decisionRecorder) add(d DecisionLog) {
+	if r.size == 0 {
+		return
+	}
+
+	if len(r.decisions) < r.size {
+		r.decisions = append(r.decisions, d)
+	} else {
+		r.decisions[r.next] = d
+	}
+
+	r.next = (r.next + 1) % r.size
+	r.count = min(r.count+1, r.size)
+}
+
+// list returns the decisions held, the most recent first.
+func (r *decisionRecorder) list() []DecisionLog {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	decisions := make([]DecisionLog, 0, r.count)
+	for i := 1; i <= r.count; i++ {
+		decisions = append(decisions, r.decisions[(r.next-i+len(r.decisions))%len(r.decisions)])
+	}
+
+	return decisions
+}
+
+// carryOver adds the decisions held by previous so that the decision log is
+// kept when an instance is replaced. They are not written to the file again.
+func (r *decisionRecorder) carryOver(previous *decisionRecorder) {
+	decisions := previous.list()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := len(decisions) - 1; i >= 0; i-- {
+		r.add(decisions[i])
+	}
+}
+
+// close closes the decision log file. Decisions which are still in flight
+// when an instance is replaced or deleted are only kept in memory.
+func (r *decisionRecorder) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	err := r.file.Close()
+	if err != nil {
+		log.Printf("failed to close decision log file: %s", err)
+	}
+
+	r.file = nil
+}
+
+// decisionLogPluginFactory creates plugins which the OPA decision logs
+// plugin is configured to hand its events to.
+type decisionLogPluginFactory struct {
+	recorder *decisionRecorder
+}
+
+func (f *decisionLogPluginFactory) Validate(_ *plugins.Manager, _ []byte) (interface{}, error) {
+	return nil, nil
+}
+
+func (f *decisionLogPluginFactory) New(manager *plugins.Manager, _ interface{}) plugins.Plugin {
+	return &decisionLogPlugin{
+		manager:  manager,
+		recorder: f.recorder,
+	}
+}
+
+type decisionLogPlugin struct {
+	manager  *plugins.Manager
+	recorder *decisionRecorder
+}
+
+func (p *decisionLogPlugin) Start(_ context.Context) error {
+	p.manager.UpdatePluginStatus(decisionLogPluginName, &plugins.Status{State: plugins.StateOK})
+	return nil
+}
+
+func (p *decisionLogPlugin) Stop(_ context.Context) {
+	p.manager.UpdatePluginStatus(decisionLogPluginName, &plugins.Status{State: plugins.StateNotReady})
+}
+
+func (p *decisionLogPlugin) Reconfigure(_ context.Context, _ interface{}) {}
+
+// Log implements logs.Logger.
+func (p *decisionLogPlugin) Log(_ context.Context, event logs.EventV1) error {
+	p.recorder.record(newDecisionLog(event))
+	return nil
+}
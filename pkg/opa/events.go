@@ -0,0 +1,107 @@
+package opa
+
+import (
+	"sync"
+)
+
+// eventBuffer is the number of events buffered for each subscriber, events
+// are dropped for subscribers which fall further behind.
+const eventBuffer = 16
+
+// ActivationEvent is published when an OPA activates a bundle, including
+// when an Update swaps in an instance with newly activated bundles.
+type ActivationEvent struct {
+	Ref      string
+	Bundle   string
+	Revision string
+}
+
+// subscribers holds the channels subscribed to the events of each ref.
+type subscribers struct {
+	lock sync.Mutex
+	refs map[string]map[chan ActivationEvent]struct{}
+}
+
+// Subscribe returns a channel receiving the activation events of the OPA
+// with the given ref. The returned function must be called to unsubscribe
+// once events are no longer read.
+func (m *Manager) Subscribe(ref string) (<-chan ActivationEvent, func()) {
+	ch := make(chan ActivationEvent, eventBuffer)
+
+	m.subscribers.lock.Lock()
+	defer m.subscribers.lock.Unlock()
+
+	if m.subscribers.refs == nil {
+		m.subscribers.refs = map[string]map[chan ActivationEvent]struct{}{}
+	}
+
+	if m.subscribers.refs[ref] == nil {
+		m.subscribers.refs[ref] = map[chan ActivationEvent]struct{}{}
+	}
+	m.subscribers.refs[ref][ch] = struct{}{}
+
+	var once sync.Once
+
+	return ch, func() {
+		once.Do(func() {
+			m.subscribers.lock.Lock()
+			defer m.subscribers.lock.Unlock()
+
+			delete(m.subscribers.refs[ref], ch)
+			if len(m.subscribers.refs[ref]) == 0 {
+				delete(m.subscribers.refs, ref)
+			}
+		})
+	}
+}
+
+func (m *Manager) publish(event ActivationEvent) {
+	m.subscribers.lock.Lock()
+	defer m.subscribers.lock.Unlock()
+
+	for ch := range m.subscribers.refs[event.Ref] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// activationHandler returns the function called when an instance for ref
+// activates a bundle. Events are only published for the instance currently
+// registered under ref, so that subscribers do not see the bundles of an
+// instance which Update has not swapped in yet.
+func (m *Manager) activationHandler(ref string) func(*instance, BundleStatus) {
+	return func(inst *instance, b BundleStatus) {
+		m.opasLock.RLock()
+		current := m.opas[ref] == inst
+		m.opasLock.RUnlock()
+
+		if !current {
+			return
+		}
+
+		m.publish(ActivationEvent{
+			Ref:      ref,
+			Bundle:   b.Name,
+			Revision: b.ActiveRevision,
+		})
+	}
+}
+
+// publishActive publishes the bundles inst has already activated, it is
+// called when inst is registered under ref as activations before then are
+// not published.
+func (m *Manager) publishActive(ref string, inst *instance) {
+	for _, b := range inst.status.get().Bundles {
+		if b.LastSuccessfulActivation.IsZero() {
+			continue
+		}
+
+		m.publish(ActivationEvent{
+			Ref:      ref,
+			Bundle:   b.Name,
+			Revision: b.ActiveRevision,
+		})
+	}
+}
@@ -1,67 +1,541 @@
 package opa
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"log"
+	"os"
+	"slices"
 	"sync"
+	"time"
 
+	"github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/plugins/bundle"
 	"github.com/open-policy-agent/opa/sdk"
+	"github.com/open-policy-agent/opa/storage/inmem"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/registry"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
 )
 
 type Manager struct {
-	opas     map[string]*sdk.OPA
+	opas     map[string]*instance
 	opasLock sync.RWMutex
+
+	store registry.Store
+
+	subscribers subscribers
+
+	metrics *managerMetrics
+}
+
+// instance is an OPA managed by the Manager along with the state tracked
+// for it.
+type instance struct {
+	cfg    config.OPA
+	opa    *sdk.OPA
+	status *statusRecorder
+
+	// decisions holds the most recent decisions made by the instance
+	decisions *decisionRecorder
+
+	// ready is closed once all bundles of the instance have been activated
+	// and their status has been reported
+	ready chan struct{}
+
+	// stopped is closed when the instance is stopped
+	stopped chan struct{}
+
+	// persisted is true when the registration of the instance is saved in
+	// the store of the Manager
+	persisted bool
+
+	// onDecision is called with the time taken to make each decision
+	onDecision func(time.Duration, error)
+
+	// cache holds recent decisions, it is nil when caching is disabled
+	cache *decisionCache
+
+	// watchers reload bundles of config.SourceKindFile sources and secrets
+	// read from files on changes
+	watchers []*fileWatcher
+
+	// persistenceDir is a temporary directory used to store pulled OCI
+	// bundles, it is removed when the instance is stopped
+	persistenceDir string
+}
+
+func (i *instance) isReady() bool {
+	select {
+	case <-i.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func NewManager(opts ...func(*Manager)) *Manager {
+	m := &Manager{
+		opas: make(map[string]*instance),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// WithStore sets the store that registrations are persisted to.
+func WithStore(store registry.Store) func(*Manager) {
+	return func(m *Manager) {
+		m.store = store
+	}
+}
+
+// ErrNotFound is returned when there is no OPA with a given ref.
+var ErrNotFound = errors.New("opa not found")
+
+// ErrAlreadyExists is returned when adding an OPA with a ref that is already
+// in use, Update must be used to replace it.
+var ErrAlreadyExists = errors.New("opa already exists")
+
+// ErrNotReady is returned when an OPA has not activated its bundle yet.
+var ErrNotReady = errors.New("opa not ready")
+
+// ErrInvalidConfig is returned when an OPA cannot be started from its
+// registration, such as when a required source setting is missing.
+var ErrInvalidConfig = errors.New("invalid opa config")
+
+// AddOption configures a call to Manager.Add.
+type AddOption func(*addOptions)
+
+type addOptions struct {
+	waitTimeout time.Duration
+	persist     bool
 }
 
-func NewManager() *Manager {
-	return &Manager{
-		opas: make(map[string]*sdk.OPA),
+// WaitForActivation makes Add wait for up to timeout for the bundle of the
+// new OPA to be activated. The OPA is registered even when the timeout is
+// reached, Ready can be used to check if it has become ready since.
+func WaitForActivation(timeout time.Duration) AddOption {
+	return func(o *addOptions) {
+		o.waitTimeout = timeout
 	}
 }
 
+// Persist makes Add save the registration to the store of the Manager so
+// that it is restored after a restart, and makes updates to it saved too.
+// It is used for registrations made at runtime, OPAs from the config file
+// are not persisted so that removing them from the file removes them.
+func Persist() AddOption {
+	return func(o *addOptions) {
+		o.persist = true
+	}
+}
+
+// Add registers a new OPA under ref. By default Add returns as soon as the
+// OPA has been started and the OPA is not ready until its bundle has been
+// activated.
 func (m *Manager) Add(
 	ctx context.Context,
 	ref string,
-	systemID string,
-	token string,
-	endpoint string,
+	cfg config.OPA,
+	opts ...AddOption,
 ) error {
+	options := &addOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	if m.Get(ref) != nil {
+		return fmt.Errorf("%s: %w", ref, ErrAlreadyExists)
+	}
+
+	inst, err := newInstance(ctx, cfg, m.instanceHooks(ref))
+	if err != nil {
+		return err
+	}
+
 	m.opasLock.Lock()
-	defer m.opasLock.Unlock()
-
-	if endpoint == "" {
-		return fmt.Errorf("endpoint must be provided")
-	}
-
-	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
-		endpoint = "http://" + endpoint
-	}
-
-	cfg := fmt.Sprintf(`
-bundles:
-  systems/%s:
-    polling:
-      max_delay_seconds: 1
-      min_delay_seconds: 1
-    resource: /bundles/systems/%s
-    service: styra
-services:
-- credentials:
-    bearer:
-      token: %s
-  name: styra
-  url: %s
-`, systemID, systemID, token, endpoint)
-
-	opa, err := sdk.New(ctx, sdk.Options{
-		Config: strings.NewReader(cfg),
+
+	// another request may have added the ref while the instance was starting
+	if _, ok := m.opas[ref]; ok {
+		m.opasLock.Unlock()
+		inst.stop(ctx)
+		return fmt.Errorf("%s: %w", ref, ErrAlreadyExists)
+	}
+
+	if m.store != nil && options.persist {
+		err = m.store.Put(ref, cfg)
+		if err != nil {
+			m.opasLock.Unlock()
+			inst.stop(ctx)
+			return fmt.Errorf("failed to persist OPA registration: %w", err)
+		}
+	}
+
+	inst.persisted = options.persist
+	m.opas[ref] = inst
+
+	m.opasLock.Unlock()
+
+	m.publishActive(ref, inst)
+
+	if options.waitTimeout > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, options.waitTimeout)
+		defer cancel()
+
+		select {
+		case <-inst.ready:
+		case <-waitCtx.Done():
+		}
+	}
+
+	return nil
+}
+
+// Update replaces the OPA registered under ref with a new instance created
+// from cfg. The new instance is only swapped in once its bundle has been
+// activated, so decisions continue to be served by the previous instance
+// until then. The previous instance is stopped after the swap.
+func (m *Manager) Update(
+	ctx context.Context,
+	ref string,
+	cfg config.OPA,
+) error {
+	if m.Get(ref) == nil {
+		return fmt.Errorf("%s: %w", ref, ErrNotFound)
+	}
+
+	inst, err := newInstance(ctx, cfg, m.instanceHooks(ref))
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-inst.ready:
+	case <-ctx.Done():
+		inst.stop(context.WithoutCancel(ctx))
+		return fmt.Errorf("bundle was not activated before update was cancelled: %w", ctx.Err())
+	}
+
+	m.opasLock.Lock()
+
+	previous, ok := m.opas[ref]
+	if !ok {
+		m.opasLock.Unlock()
+		inst.stop(ctx)
+		return fmt.Errorf("%s: %w", ref, ErrNotFound)
+	}
+
+	if m.store != nil && previous.persisted {
+		err = m.store.Put(ref, cfg)
+		if err != nil {
+			m.opasLock.Unlock()
+			inst.stop(ctx)
+			return fmt.Errorf("failed to persist OPA registration: %w", err)
+		}
+	}
+
+	inst.persisted = previous.persisted
+	inst.decisions.carryOver(previous.decisions)
+
+	m.opas[ref] = inst
+
+	m.opasLock.Unlock()
+
+	m.publishActive(ref, inst)
+
+	previous.stop(ctx)
+
+	return nil
+}
+
+// instanceHooks are called as an instance runs, they are used by the Manager
+// to publish events and record metrics for the ref of the instance.
+type instanceHooks struct {
+	onActivation func(*instance, BundleStatus)
+	onDownload   func(BundleStatus)
+	onDecision   func(time.Duration, error)
+
+	// onSecretChange is called when a file a secret of the instance is read
+	// from changes
+	onSecretChange func(*instance)
+}
+
+func (m *Manager) instanceHooks(ref string) instanceHooks {
+	publish := m.activationHandler(ref)
+
+	return instanceHooks{
+		onActivation: func(inst *instance, b BundleStatus) {
+			m.metrics.observeActivation(ref, b)
+			publish(inst, b)
+		},
+		onDownload: func(b BundleStatus) {
+			m.metrics.observeDownload(ref, b)
+		},
+		onDecision: func(duration time.Duration, err error) {
+			m.metrics.observeDecision(ref, duration, err)
+		},
+		onSecretChange: func(inst *instance) {
+			go m.reloadSecrets(ref, inst)
+		},
+	}
+}
+
+// secretReloadTimeout is how long the instance started with reloaded
+// secrets may take to activate its bundles before it is abandoned.
+const secretReloadTimeout = time.Minute
+
+// reloadSecrets replaces inst with an instance using the current secrets of
+// its registration, the instance is swapped in once its bundles have been
+// activated as with Update. Nothing is done if inst has already been
+// replaced or deleted.
+func (m *Manager) reloadSecrets(ref string, inst *instance) {
+	m.opasLock.RLock()
+	current := m.opas[ref]
+	m.opasLock.RUnlock()
+
+	if current != inst {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretReloadTimeout)
+	defer cancel()
+
+	err := m.Update(ctx, ref, inst.cfg)
+	if err != nil {
+		log.Printf("failed to reload secrets of %s: %s", ref, err)
+	}
+}
+
+// newInstance starts an OPA for cfg without waiting for its bundle to be
+// activated, the ready channel of the instance is closed once it has been.
+// The hooks are called as the instance downloads and activates bundles and
+// makes decisions.
+func newInstance(
+	ctx context.Context,
+	cfg config.OPA,
+	hooks instanceHooks,
+) (*instance, error) {
+	inst := &instance{
+		cfg:        cfg,
+		ready:      make(chan struct{}),
+		stopped:    make(chan struct{}),
+		onDecision: hooks.onDecision,
+	}
+
+	inst.status = &statusRecorder{
+		onActivation: func(b BundleStatus) {
+			hooks.onActivation(inst, b)
+		},
+		onDownload: hooks.onDownload,
+		activated:  make(chan struct{}),
+		expected:   len(cfg.Sources()),
+	}
+
+	err := cfg.Demo.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("%w: demo settings: %w", ErrInvalidConfig, err)
+	}
+
+	err = cfg.DecisionLogs.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("%w: decision log settings: %w", ErrInvalidConfig, err)
+	}
+
+	err = cfg.Cache.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("%w: cache settings: %w", ErrInvalidConfig, err)
+	}
+
+	store := inmem.New()
+
+	if cfg.Cache.Enabled() {
+		inst.cache = newDecisionCache(cfg.Cache.Size)
+
+		err = inst.cache.registerInvalidation(ctx, store)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register cache invalidation: %w", err)
+		}
+	}
+
+	sources := cfg.Sources()
+
+	// OCI bundles are pulled into a local store, each instance has its own
+	// so that concurrent pulls do not interfere with each other
+	if slices.ContainsFunc(sources, func(b config.Bundle) bool { return b.Kind == config.SourceKindOCI }) {
+		inst.persistenceDir, err = os.MkdirTemp("", "demo-live-policy-update-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OCI store: %w", err)
+		}
+	}
+
+	// secret references are resolved for the OPA config only, the
+	// registration keeps the references so that they are never persisted
+	resolved, err := cfg.ResolveSecrets(ctx)
+	if err != nil {
+		inst.removePersistenceDir()
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	sdkCfg, err := buildSDKConfig(resolved, inst.persistenceDir)
+	if err != nil {
+		inst.removePersistenceDir()
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	inst.decisions, err = newDecisionRecorder(cfg.DecisionLogs)
+	if err != nil {
+		inst.removePersistenceDir()
+		return nil, err
+	}
+
+	sdkReady := make(chan struct{})
+
+	// the instance outlives the request that created it, so it must not be
+	// stopped when ctx is cancelled
+	inst.opa, err = sdk.New(context.WithoutCancel(ctx), sdk.Options{
+		Config: bytes.NewReader(sdkCfg),
+		Ready:  sdkReady,
+		Store:  store,
+		Plugins: map[string]plugins.Factory{
+			statusPluginName:      &statusPluginFactory{recorder: inst.status},
+			decisionLogPluginName: &decisionLogPluginFactory{recorder: inst.decisions},
+		},
 	})
 	if err != nil {
-		return fmt.Errorf("unexpected error creating OPA instance: %w", err)
+		inst.decisions.close()
+		inst.removePersistenceDir()
+		return nil, fmt.Errorf("unexpected error creating OPA instance: %w", err)
 	}
 
-	m.opas[ref] = opa
+	go inst.awaitReady(sdkReady)
+
+	// manual sources do not download anything by themselves, so the first
+	// download is triggered here to allow the instance to become ready
+	if slices.ContainsFunc(sources, func(b config.Bundle) bool { return b.Trigger == config.TriggerManual }) {
+		go func() {
+			_ = inst.refresh(context.WithoutCancel(ctx))
+		}()
+	}
+
+	refreshCtx := context.WithoutCancel(ctx)
+
+	for _, b := range sources {
+		if b.Kind != config.SourceKindFile {
+			continue
+		}
+
+		watcher, err := watchPath(b.Path, func() {
+			_ = inst.refresh(refreshCtx)
+		})
+		if err != nil {
+			inst.stop(ctx)
+			return nil, err
+		}
+
+		inst.watchers = append(inst.watchers, watcher)
+	}
+
+	for _, path := range cfg.SecretFiles() {
+		watcher, err := watchPath(path, func() {
+			hooks.onSecretChange(inst)
+		})
+		if err != nil {
+			inst.stop(ctx)
+			return nil, err
+		}
+
+		inst.watchers = append(inst.watchers, watcher)
+	}
+
+	return inst, nil
+}
+
+// awaitReady closes the ready channel of the instance once OPA is ready and
+// the status of every bundle shows it has been activated. OPA reports
+// readiness before the status plugin is updated, waiting for both means
+// ready instances always report their active revisions.
+func (i *instance) awaitReady(sdkReady <-chan struct{}) {
+	for _, c := range []<-chan struct{}{sdkReady, i.status.activated} {
+		select {
+		case <-c:
+		case <-i.stopped:
+			return
+		}
+	}
+
+	close(i.ready)
+}
+
+// stop stops the OPA and any file watchers of the instance.
+func (i *instance) stop(ctx context.Context) {
+	close(i.stopped)
+
+	for _, watcher := range i.watchers {
+		err := watcher.stop()
+		if err != nil {
+			log.Printf("failed to stop watcher: %s", err)
+		}
+	}
+
+	i.opa.Stop(ctx)
+
+	i.decisions.close()
+
+	i.removePersistenceDir()
+}
+
+func (i *instance) removePersistenceDir() {
+	if i.persistenceDir == "" {
+		return
+	}
+
+	err := os.RemoveAll(i.persistenceDir)
+	if err != nil {
+		log.Printf("failed to remove %s: %s", i.persistenceDir, err)
+	}
+}
+
+// refresh triggers an immediate download of the bundles of the instance,
+// errors are reported in the bundle status.
+func (i *instance) refresh(ctx context.Context) error {
+	p, ok := i.opa.Plugin(bundle.Name).(*bundle.Plugin)
+	if !ok {
+		return fmt.Errorf("bundle plugin is not configured")
+	}
+
+	return p.Trigger(ctx)
+}
+
+// Restore adds the OPAs held in the store which are not already registered.
+// OPAs which fail to start are logged and skipped so that a single broken
+// registration does not prevent the others from being restored, they are
+// kept in the store and retried on the next restore.
+func (m *Manager) Restore(ctx context.Context) error {
+	if m.store == nil {
+		return nil
+	}
+
+	stored, err := m.store.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load OPA registrations: %w", err)
+	}
+
+	for ref, cfg := range stored {
+		if m.Get(ref) != nil {
+			continue
+		}
+
+		err = m.Add(ctx, ref, cfg, Persist())
+		if err != nil {
+			log.Printf("failed to restore opa %s: %s", ref, err)
+		}
+	}
 
 	return nil
 }
@@ -70,21 +544,203 @@ func (m *Manager) Get(ref string) *sdk.OPA {
 	m.opasLock.RLock()
 	defer m.opasLock.RUnlock()
 
-	return m.opas[ref]
+	inst, ok := m.opas[ref]
+	if !ok {
+		return nil
+	}
+
+	return inst.opa
+}
+
+// Refresh forces the OPA with the given ref to download its bundles now
+// rather than waiting for the next poll. It is required to pick up updates
+// for sources using config.TriggerManual.
+func (m *Manager) Refresh(ctx context.Context, ref string) error {
+	m.opasLock.RLock()
+	inst, ok := m.opas[ref]
+	m.opasLock.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("%s: %w", ref, ErrNotFound)
+	}
+
+	return inst.refresh(ctx)
+}
+
+// Decision evaluates a decision on the OPA with the given ref. ErrNotReady is
+// returned until the bundles of the OPA have been activated.
+func (m *Manager) Decision(
+	ctx context.Context,
+	ref string,
+	options sdk.DecisionOptions,
+) (*sdk.DecisionResult, error) {
+	inst, err := m.readyInstance(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return inst.decision(ctx, options)
+}
+
+// Partial partially evaluates a query on the OPA with the given ref, treating
+// the references in options.Unknowns as unknown. ErrNotReady is returned until
+// the bundles of the OPA have been activated.
+func (m *Manager) Partial(
+	ctx context.Context,
+	ref string,
+	options sdk.PartialOptions,
+) (*sdk.PartialResult, error) {
+	inst, err := m.readyInstance(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return inst.opa.Partial(ctx, options)
+}
+
+// readyInstance returns the instance registered under ref, or an error if
+// there is none or it is not ready to serve decisions.
+func (m *Manager) readyInstance(ref string) (*instance, error) {
+	m.opasLock.RLock()
+	inst, ok := m.opas[ref]
+	m.opasLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", ref, ErrNotFound)
+	}
+
+	if !inst.isReady() {
+		return nil, fmt.Errorf("%s: %w", ref, ErrNotReady)
+	}
+
+	return inst, nil
+}
+
+func (i *instance) decision(ctx context.Context, options sdk.DecisionOptions) (*sdk.DecisionResult, error) {
+	start := time.Now()
+
+	var dr *sdk.DecisionResult
+	var hit bool
+	var err error
+	if i.cache != nil {
+		dr, hit, err = i.cache.decision(options, func() (*sdk.DecisionResult, error) {
+			return i.opa.Decision(ctx, options)
+		})
+	} else {
+		dr, err = i.opa.Decision(ctx, options)
+	}
+
+	// decisions served from the cache are not seen by the decision log
+	// plugin, so they are recorded here under an ID of their own
+	if hit {
+		d := newCachedDecisionLog(options, dr, err, start)
+		if dr != nil {
+			dr.ID = d.ID
+		}
+
+		i.decisions.record(d)
+	}
+
+	if i.onDecision != nil {
+		i.onDecision(time.Since(start), err)
+	}
+
+	return dr, err
+}
+
+// Decisions returns the most recent decisions made by the OPA with the given
+// ref, the most recent first.
+func (m *Manager) Decisions(ref string) ([]DecisionLog, error) {
+	m.opasLock.RLock()
+	inst, ok := m.opas[ref]
+	m.opasLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", ref, ErrNotFound)
+	}
+
+	return inst.decisions.list(), nil
+}
+
+// Ready returns true if the OPA with the given ref has activated its bundle
+// and is able to serve decisions.
+func (m *Manager) Ready(ref string) bool {
+	m.opasLock.RLock()
+	defer m.opasLock.RUnlock()
+
+	inst, ok := m.opas[ref]
+	if !ok {
+		return false
+	}
+
+	return inst.isReady()
+}
+
+// Config returns the registration of the OPA with the given ref, or nil if
+// there is no such OPA.
+func (m *Manager) Config(ref string) *config.OPA {
+	m.opasLock.RLock()
+	defer m.opasLock.RUnlock()
+
+	inst, ok := m.opas[ref]
+	if !ok {
+		return nil
+	}
+
+	cfg := inst.cfg
+
+	return &cfg
+}
+
+// Status returns the latest bundle status reported by the OPA with the given
+// ref, or nil if there is no such OPA.
+func (m *Manager) Status(ref string) *Status {
+	m.opasLock.RLock()
+	defer m.opasLock.RUnlock()
+
+	inst, ok := m.opas[ref]
+	if !ok {
+		return nil
+	}
+
+	s := inst.status.get()
+	s.Ready = inst.isReady()
+
+	if inst.cache != nil {
+		stats := inst.cache.getStats()
+		s.Cache = &stats
+	}
+
+	return &s
 }
 
-func (m *Manager) Delete(ctx context.Context, ref string) {
+func (m *Manager) Delete(ctx context.Context, ref string) error {
 	m.opasLock.Lock()
-	defer m.opasLock.Unlock()
+
+	if m.store != nil {
+		err := m.store.Delete(ref)
+		if err != nil {
+			m.opasLock.Unlock()
+			return fmt.Errorf("failed to delete OPA registration: %w", err)
+		}
+	}
 
 	s, ok := m.opas[ref]
+	delete(m.opas, ref)
+
+	m.opasLock.Unlock()
+
 	if !ok {
-		return
+		return nil
 	}
 
-	s.Stop(ctx)
+	// the instance is stopped without holding the lock as stopping waits for
+	// bundle activations, which look up the instance to publish events
+	s.stop(ctx)
 
-	delete(m.opas, ref)
+	m.metrics.delete(ref)
+
+	return nil
 }
 
 func (m *Manager) List() []string {
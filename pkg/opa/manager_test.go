@@ -1,15 +1,31 @@
 package opa
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 	"github.com/open-policy-agent/opa/sdk"
+	"github.com/open-policy-agent/opa/server/types"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/registry"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
 )
 
 func TestNewManager(t *testing.T) {
@@ -96,12 +112,24 @@ allow if input.name in {"diane", "erin", "frank"}
 
 	ctx := context.Background()
 
-	err = m.Add(ctx, "example1", "example1", "example1-token", testServer.Listener.Addr().String())
+	err = m.Add(ctx, "example1", config.OPA{
+		Source: config.Source{
+			SystemID: "example1",
+			Token:    "example1-token",
+			Endpoint: testServer.Listener.Addr().String(),
+		},
+	}, WaitForActivation(5*time.Second))
 	if err != nil {
 		t.Fatalf("unexpected error adding OPA: %s", err)
 	}
 
-	err = m.Add(ctx, "example2", "example2", "example2-token", testServer.Listener.Addr().String())
+	err = m.Add(ctx, "example2", config.OPA{
+		Source: config.Source{
+			SystemID: "example2",
+			Token:    "example2-token",
+			Endpoint: testServer.Listener.Addr().String(),
+		},
+	}, WaitForActivation(5*time.Second))
 	if err != nil {
 		t.Fatalf("unexpected error adding OPA: %s", err)
 	}
@@ -252,3 +280,2118 @@ allow if input.name in {"eve"}
 		time.Sleep(500 * time.Millisecond)
 	}
 }
+
+func TestNewManagerHTTPSource(t *testing.T) {
+	var err error
+
+	modulePath := "policy/allow.rego"
+
+	exampleMod := `
+package policy
+
+import rego.v1
+
+default allow := false
+allow if input.name == "alice"
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/static/policies/example.tar.gz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("expected no authorization header, got %s", r.Header.Get("Authorization"))
+		}
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		w.Header().Set("etag", exampleBundle.Manifest.Revision)
+		err = bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	err = m.Add(ctx, "example", config.OPA{
+		Source: config.Source{
+			Kind:     config.SourceKindHTTP,
+			Endpoint: testServer.URL + "/static",
+			Resource: "policies/example.tar.gz",
+		},
+	}, WaitForActivation(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	dr, err := m.Get("example").Decision(ctx, sdk.DecisionOptions{
+		Path: "/policy/allow",
+		Input: map[string]interface{}{
+			"name": "alice",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error evaluating decision: %s", err)
+	}
+	if dr.Result != true {
+		t.Fatalf("expected result to be true, got %v", dr.Result)
+	}
+}
+
+func TestAddInvalidSource(t *testing.T) {
+	m := NewManager()
+
+	testCases := map[string]config.Source{
+		"missing endpoint":  {SystemID: "example"},
+		"missing system id": {Endpoint: "localhost:8181"},
+		"missing resource":  {Kind: config.SourceKindHTTP, Endpoint: "localhost:8181"},
+		"unknown kind":      {Kind: "ftp", Endpoint: "localhost:8181"},
+	}
+
+	for name, source := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := m.Add(context.Background(), "example", config.OPA{Source: source})
+			if err == nil {
+				t.Fatalf("expected error adding OPA")
+			}
+		})
+	}
+
+	if len(m.List()) != 0 {
+		t.Fatalf("expected no OPAs to be registered")
+	}
+}
+
+func TestManagerStatus(t *testing.T) {
+	var err error
+
+	modulePath := "policy/allow.rego"
+	exampleMod := `package policy
+default allow := true`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "rev-1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		w.Header().Set("etag", exampleBundle.Manifest.Revision)
+		err := bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	if m.Status("example") != nil {
+		t.Fatalf("expected no status for unknown OPA")
+	}
+
+	err = m.Add(ctx, "example", config.OPA{
+		Source: config.Source{
+			SystemID: "example",
+			Token:    "example-token",
+			Endpoint: testServer.Listener.Addr().String(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	// the status is reported after the bundle is activated, and may be slow
+	// to arrive when the machine is busy
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		status := m.Status("example")
+		if status == nil {
+			t.Fatalf("expected status to be present")
+		}
+
+		if len(status.Bundles) == 1 && status.Bundles[0].ActiveRevision == "rev-1" {
+			bs := status.Bundles[0]
+			if bs.Name != "systems/example" {
+				t.Fatalf("unexpected bundle name: %s", bs.Name)
+			}
+			if bs.LastSuccessfulActivation.IsZero() || bs.LastSuccessfulDownload.IsZero() || bs.LastRequest.IsZero() {
+				t.Fatalf("expected timestamps to be set: %+v", bs)
+			}
+			if bs.HTTPCode != "" || len(bs.Errors) != 0 {
+				t.Fatalf("expected no errors: %+v", bs)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected active revision to be reported, got %+v", status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestManagerRestore(t *testing.T) {
+	var err error
+
+	modulePath := "policy/allow.rego"
+	exampleMod := `package policy
+default allow := true`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		w.Header().Set("etag", exampleBundle.Manifest.Revision)
+		err = bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	store, err := registry.NewFileStore(
+		filepath.Join(t.TempDir(), "registry.json"),
+		bytes.Repeat([]byte("k"), registry.KeySize),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %s", err)
+	}
+
+	ctx := context.Background()
+
+	m := NewManager(WithStore(store))
+
+	for _, ref := range []string{"example1", "example2"} {
+		err = m.Add(ctx, ref, config.OPA{
+			Source: config.Source{
+				SystemID: ref,
+				Token:    ref + "-token",
+				Endpoint: testServer.Listener.Addr().String(),
+			},
+		}, Persist())
+		if err != nil {
+			t.Fatalf("unexpected error adding OPA: %s", err)
+		}
+	}
+
+	// OPAs from the config file are not persisted
+	err = m.Add(ctx, "static", config.OPA{
+		Source: config.Source{
+			SystemID: "static",
+			Token:    "static-token",
+			Endpoint: testServer.Listener.Addr().String(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	err = m.Delete(ctx, "example2")
+	if err != nil {
+		t.Fatalf("unexpected error deleting OPA: %s", err)
+	}
+
+	// a registration which can no longer be started must not prevent the
+	// others from being restored
+	err = store.Put("broken", config.OPA{
+		Source: config.Source{
+			SystemID: "broken",
+			Token:    "${DEMO_LIVE_POLICY_UPDATE_MISSING_TOKEN}",
+			Endpoint: testServer.Listener.Addr().String(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error storing OPA: %s", err)
+	}
+
+	// a new manager using the same store simulates a restart of the server
+	restarted := NewManager(WithStore(store))
+
+	err = restarted.Restore(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error restoring OPAs: %s", err)
+	}
+
+	refs := restarted.List()
+	if len(refs) != 1 || refs[0] != "example1" {
+		t.Fatalf("unexpected restored OPAs: %v", refs)
+	}
+}
+
+func TestManagerUpdate(t *testing.T) {
+	var err error
+
+	modulePath := "policy/allow.rego"
+
+	bundles := map[string]*bundle.Bundle{}
+	for _, name := range []string{"alice", "bob"} {
+		mod := fmt.Sprintf(`package policy
+import rego.v1
+default allow := false
+allow if input.name == %q`, name)
+
+		bundles["/bundles/systems/"+name] = &bundle.Bundle{
+			Manifest: bundle.Manifest{
+				Revision: name,
+			},
+			Modules: []bundle.ModuleFile{
+				{
+					URL:    modulePath,
+					Path:   modulePath,
+					Parsed: ast.MustParseModule(mod),
+					Raw:    []byte(mod),
+				},
+			},
+		}
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		b, ok := bundles[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		w.Header().Set("etag", b.Manifest.Revision)
+		err = bundle.NewWriter(w).Write(*b)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	cfg := config.OPA{
+		Source: config.Source{
+			SystemID: "alice",
+			Token:    "example-token",
+			Endpoint: testServer.Listener.Addr().String(),
+		},
+	}
+
+	err = m.Update(ctx, "example", cfg)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found error updating unknown OPA, got %v", err)
+	}
+
+	err = m.Add(ctx, "example", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	err = m.Add(ctx, "example", cfg)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected already exists error adding OPA twice, got %v", err)
+	}
+
+	previous := m.Get("example")
+
+	cfg.SystemID = "bob"
+	err = m.Update(ctx, "example", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error updating OPA: %s", err)
+	}
+
+	if m.Get("example") == previous {
+		t.Fatalf("expected OPA instance to be replaced")
+	}
+
+	if m.Config("example").SystemID != "bob" {
+		t.Fatalf("unexpected config after update: %+v", m.Config("example"))
+	}
+
+	// the new instance must have its bundle activated as soon as it is
+	// swapped in
+	dr, err := m.Get("example").Decision(ctx, sdk.DecisionOptions{
+		Path: "/policy/allow",
+		Input: map[string]interface{}{
+			"name": "bob",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error evaluating decision: %s", err)
+	}
+	if dr.Result != true {
+		t.Fatalf("expected bob to be allowed after update, got %v", dr.Result)
+	}
+
+	if len(m.List()) != 1 {
+		t.Fatalf("expected a single OPA after update, got %v", m.List())
+	}
+}
+
+func TestManagerReady(t *testing.T) {
+	var err error
+
+	modulePath := "policy/allow.rego"
+	exampleMod := `package policy
+default allow := true`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	available := make(chan struct{})
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-available:
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		w.Header().Set("etag", exampleBundle.Manifest.Revision)
+		err = bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	if m.Ready("example") {
+		t.Fatalf("expected unknown OPA not to be ready")
+	}
+
+	start := time.Now()
+	err = m.Add(ctx, "example", config.OPA{
+		Source: config.Source{
+			SystemID: "example",
+			Token:    "example-token",
+			Endpoint: testServer.Listener.Addr().String(),
+		},
+	}, WaitForActivation(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("expected Add to wait for activation")
+	}
+
+	if m.Get("example") == nil {
+		t.Fatalf("expected OPA to be registered before it is ready")
+	}
+
+	if m.Ready("example") {
+		t.Fatalf("expected OPA not to be ready while the bundle is missing")
+	}
+
+	if m.Status("example").Ready {
+		t.Fatalf("expected status not to be ready while the bundle is missing")
+	}
+
+	close(available)
+
+	retries := 30
+	for !m.Ready("example") {
+		retries--
+		if retries == 0 {
+			t.Fatalf("expected OPA to become ready once the bundle is available")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestManagerManualTrigger(t *testing.T) {
+	var err error
+
+	modulePath := "policy/allow.rego"
+
+	newBundle := func(name string) *bundle.Bundle {
+		mod := fmt.Sprintf(`package policy
+import rego.v1
+default allow := false
+allow if input.name == %q`, name)
+
+		return &bundle.Bundle{
+			Manifest: bundle.Manifest{
+				Revision: name,
+			},
+			Modules: []bundle.ModuleFile{
+				{
+					URL:    modulePath,
+					Path:   modulePath,
+					Parsed: ast.MustParseModule(mod),
+					Raw:    []byte(mod),
+				},
+			},
+		}
+	}
+
+	var bundleLock sync.Mutex
+	currentBundle := newBundle("alice")
+	requests := 0
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		bundleLock.Lock()
+		defer bundleLock.Unlock()
+
+		requests++
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		w.Header().Set("etag", currentBundle.Manifest.Revision)
+		err = bundle.NewWriter(w).Write(*currentBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	err = m.Refresh(ctx, "example")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found error refreshing unknown OPA, got %v", err)
+	}
+
+	err = m.Add(ctx, "example", config.OPA{
+		Source: config.Source{
+			SystemID: "example",
+			Token:    "example-token",
+			Endpoint: testServer.Listener.Addr().String(),
+			Trigger:  config.TriggerManual,
+		},
+	}, WaitForActivation(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	if !m.Ready("example") {
+		t.Fatalf("expected manual OPA to be ready after the initial download")
+	}
+
+	bundleLock.Lock()
+	currentBundle = newBundle("bob")
+	bundleLock.Unlock()
+
+	// the default polling interval is one second, a manual OPA must not poll
+	time.Sleep(1500 * time.Millisecond)
+
+	bundleLock.Lock()
+	if requests != 1 {
+		t.Fatalf("expected a single bundle request before refresh, got %d", requests)
+	}
+	bundleLock.Unlock()
+
+	err = m.Refresh(ctx, "example")
+	if err != nil {
+		t.Fatalf("unexpected error refreshing OPA: %s", err)
+	}
+
+	dr, err := m.Get("example").Decision(ctx, sdk.DecisionOptions{
+		Path: "/policy/allow",
+		Input: map[string]interface{}{
+			"name": "bob",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error evaluating decision: %s", err)
+	}
+	if dr.Result != true {
+		t.Fatalf("expected bob to be allowed after refresh, got %v", dr.Result)
+	}
+}
+
+func TestAddInvalidPolling(t *testing.T) {
+	m := NewManager()
+
+	testCases := map[string]config.Source{
+		"min greater than max": {
+			SystemID: "example",
+			Endpoint: "localhost:8181",
+			Polling:  config.Polling{MinDelaySeconds: 10, MaxDelaySeconds: 5},
+		},
+		"negative delay": {
+			SystemID: "example",
+			Endpoint: "localhost:8181",
+			Polling:  config.Polling{MinDelaySeconds: -1},
+		},
+		"unknown trigger": {
+			SystemID: "example",
+			Endpoint: "localhost:8181",
+			Trigger:  "sometimes",
+		},
+	}
+
+	for name, source := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := m.Add(context.Background(), "example", config.OPA{Source: source})
+			if err == nil {
+				t.Fatalf("expected error adding OPA")
+			}
+		})
+	}
+}
+
+func TestManagerFileSource(t *testing.T) {
+	var err error
+
+	dir := t.TempDir()
+	policyPath := filepath.Join(dir, "policy", "allow.rego")
+
+	writePolicy := func(name string) {
+		err := os.MkdirAll(filepath.Dir(policyPath), 0o755)
+		if err != nil {
+			t.Fatalf("unexpected error creating policy dir: %s", err)
+		}
+
+		err = os.WriteFile(policyPath, []byte(fmt.Sprintf(`package policy
+import rego.v1
+default allow := false
+allow if input.name == %q`, name)), 0o644)
+		if err != nil {
+			t.Fatalf("unexpected error writing policy: %s", err)
+		}
+	}
+
+	writePolicy("alice")
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	err = m.Add(ctx, "example", config.OPA{
+		Source: config.Source{
+			Kind: config.SourceKindFile,
+			Path: dir,
+		},
+	}, WaitForActivation(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example")
+
+	allowed := func(name string) bool {
+		dr, err := m.Get("example").Decision(ctx, sdk.DecisionOptions{
+			Path: "/policy/allow",
+			Input: map[string]interface{}{
+				"name": name,
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error evaluating decision: %s", err)
+		}
+
+		return dr.Result == true
+	}
+
+	if !allowed("alice") {
+		t.Fatalf("expected alice to be allowed by the initial policy")
+	}
+
+	writePolicy("bob")
+
+	retries := 20
+	for !allowed("bob") {
+		retries--
+		if retries == 0 {
+			t.Fatalf("expected bob to be allowed after the policy was saved")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestManagerFileSourceMissingPath(t *testing.T) {
+	m := NewManager()
+
+	err := m.Add(context.Background(), "example", config.OPA{
+		Source: config.Source{
+			Kind: config.SourceKindFile,
+			Path: filepath.Join(t.TempDir(), "missing"),
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected error adding OPA with a missing path")
+	}
+
+	if m.Get("example") != nil {
+		t.Fatalf("expected OPA not to be registered")
+	}
+}
+
+func TestManagerOCISource(t *testing.T) {
+	modulePath := "policy/allow.rego"
+
+	exampleMod := `
+package policy
+
+import rego.v1
+
+default allow := false
+allow if input.name == "alice"
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Data: map[string]interface{}{},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	layer := &bytes.Buffer{}
+	err := bundle.NewWriter(layer).Write(*exampleBundle)
+	if err != nil {
+		t.Fatalf("unexpected error writing bundle: %s", err)
+	}
+
+	digest := func(b []byte) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+	}
+
+	configBlob := []byte("{}")
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.config.v1+json",
+			"digest":    digest(configBlob),
+			"size":      len(configBlob),
+		},
+		"layers": []map[string]interface{}{
+			{
+				"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+				"digest":    digest(layer.Bytes()),
+				"size":      layer.Len(),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error encoding manifest: %s", err)
+	}
+
+	blobs := map[string][]byte{
+		digest(configBlob):    configBlob,
+		digest(layer.Bytes()): layer.Bytes(),
+	}
+
+	expectedAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != expectedAuth {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var body []byte
+		switch {
+		case r.URL.Path == "/v2/" || r.URL.Path == "/v2":
+			w.WriteHeader(http.StatusOK)
+			return
+		case r.URL.Path == "/v2/org/policy/manifests/latest",
+			r.URL.Path == "/v2/org/policy/manifests/"+digest(manifest):
+			body = manifest
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		case strings.HasPrefix(r.URL.Path, "/v2/org/policy/blobs/"):
+			var ok bool
+			body, ok = blobs[strings.TrimPrefix(r.URL.Path, "/v2/org/policy/blobs/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Docker-Content-Digest", digest(body))
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.WriteHeader(http.StatusOK)
+
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(body)
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	err = m.Add(ctx, "example", config.OPA{
+		Source: config.Source{
+			Kind:      config.SourceKindOCI,
+			Endpoint:  testServer.URL,
+			Reference: "registry.example.com/org/policy:latest",
+			Username:  "user",
+			Password:  "pass",
+		},
+	}, WaitForActivation(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example")
+
+	if !m.Ready("example") {
+		t.Fatalf("expected OPA to be ready, got status %v", m.Status("example"))
+	}
+
+	dr, err := m.Get("example").Decision(ctx, sdk.DecisionOptions{
+		Path: "/policy/allow",
+		Input: map[string]interface{}{
+			"name": "alice",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error evaluating decision: %s", err)
+	}
+	if dr.Result != true {
+		t.Fatalf("expected result to be true, got %v", dr.Result)
+	}
+}
+
+func TestManagerSignedBundle(t *testing.T) {
+	modulePath := "policy/allow.rego"
+
+	exampleMod := `
+package policy
+
+import rego.v1
+
+default allow := false
+allow if input.name == "alice"
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Data: map[string]interface{}{},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	err := exampleBundle.GenerateSignature(bundle.NewSigningConfig("secret", "HS256", ""), "demo", false)
+	if err != nil {
+		t.Fatalf("unexpected error signing bundle: %s", err)
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	source := config.Source{
+		Kind:     config.SourceKindHTTP,
+		Endpoint: testServer.URL,
+		Resource: "bundle.tar.gz",
+		Verification: config.Verification{
+			KeyID:  "demo",
+			Secret: "secret",
+		},
+	}
+
+	err = m.Add(ctx, "trusted", config.OPA{Source: source}, WaitForActivation(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "trusted")
+
+	if !m.Ready("trusted") {
+		t.Fatalf("expected OPA with the signing key to be ready, got status %v", m.Status("trusted"))
+	}
+
+	source.Verification.Secret = "wrong"
+
+	err = m.Add(ctx, "untrusted", config.OPA{Source: source}, WaitForActivation(2*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "untrusted")
+
+	if m.Ready("untrusted") {
+		t.Fatalf("expected OPA with the wrong signing key not to be ready")
+	}
+
+	status := m.Status("untrusted")
+	if len(status.Bundles) != 1 {
+		t.Fatalf("expected one bundle status, got %v", status.Bundles)
+	}
+
+	if !status.Bundles[0].SignatureRejected {
+		t.Fatalf("expected bundle to be reported as rejected, got %+v", status.Bundles[0])
+	}
+}
+
+func TestManagerMultipleBundles(t *testing.T) {
+	modulePath := "policy/allow.rego"
+
+	policyMod := `
+package policy
+
+import rego.v1
+
+default allow := false
+allow if input.name in data.users
+`
+
+	policyBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "policy-1",
+			Roots:    &[]string{"policy"},
+		},
+		Data: map[string]interface{}{},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(policyMod),
+				Raw:    []byte(policyMod),
+			},
+		},
+	}
+
+	dataBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "data-1",
+			Roots:    &[]string{"users"},
+		},
+		Data: map[string]interface{}{
+			"users": []interface{}{"alice"},
+		},
+	}
+
+	bundleServer := func(b *bundle.Bundle) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+			err := bundle.NewWriter(w).Write(*b)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}))
+	}
+
+	policyServer := bundleServer(policyBundle)
+	defer policyServer.Close()
+
+	dataServer := bundleServer(dataBundle)
+	defer dataServer.Close()
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	err := m.Add(ctx, "example", config.OPA{
+		Source: config.Source{
+			Kind:     config.SourceKindHTTP,
+			Endpoint: policyServer.URL,
+			Resource: "policy.tar.gz",
+		},
+		Bundles: []config.Bundle{
+			{
+				Name: "users",
+				Source: config.Source{
+					Kind:     config.SourceKindHTTP,
+					Endpoint: dataServer.URL,
+					Resource: "data.tar.gz",
+					Polling: config.Polling{
+						MinDelaySeconds: 5,
+						MaxDelaySeconds: 10,
+					},
+				},
+			},
+		},
+	}, WaitForActivation(15*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example")
+
+	if !m.Ready("example") {
+		t.Fatalf("expected OPA to be ready once both bundles are activated, got %+v", m.Status("example"))
+	}
+
+	expectedRevisions := map[string]string{
+		"policy.tar.gz": "policy-1",
+		"users":         "data-1",
+	}
+
+	// the status of each bundle is reported separately from activation, and
+	// may be slow to arrive when the machine is busy
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		revisions := map[string]string{}
+		for _, b := range m.Status("example").Bundles {
+			revisions[b.Name] = b.ActiveRevision
+		}
+
+		if reflect.DeepEqual(revisions, expectedRevisions) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected bundle revisions: %v", revisions)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	dr, err := m.Get("example").Decision(ctx, sdk.DecisionOptions{
+		Path: "/policy/allow",
+		Input: map[string]interface{}{
+			"name": "alice",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error evaluating decision: %s", err)
+	}
+	if dr.Result != true {
+		t.Fatalf("expected result to be true, got %v", dr.Result)
+	}
+}
+
+func TestAddDuplicateBundleName(t *testing.T) {
+	m := NewManager()
+
+	err := m.Add(context.Background(), "example", config.OPA{
+		Source: config.Source{
+			Kind:     config.SourceKindHTTP,
+			Endpoint: "http://localhost",
+			Resource: "bundle.tar.gz",
+		},
+		Bundles: []config.Bundle{
+			{
+				Name: "bundle.tar.gz",
+				Source: config.Source{
+					Kind:     config.SourceKindHTTP,
+					Endpoint: "http://localhost",
+					Resource: "other.tar.gz",
+				},
+			},
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected error adding OPA with duplicate bundle names")
+	}
+}
+
+func TestConsistentProvenance(t *testing.T) {
+	result := func(revision string) BatchResult {
+		return BatchResult{
+			Result: &sdk.DecisionResult{
+				Provenance: types.ProvenanceV1{
+					Bundles: map[string]types.ProvenanceBundleV1{
+						"example": {Revision: revision},
+					},
+				},
+			},
+		}
+	}
+
+	failed := BatchResult{Err: errors.New("failed")}
+
+	if !consistentProvenance([]BatchResult{result("1"), failed, result("1")}) {
+		t.Fatalf("expected results with the same revision to be consistent")
+	}
+
+	if consistentProvenance([]BatchResult{result("1"), failed, result("2")}) {
+		t.Fatalf("expected results with different revisions to be inconsistent")
+	}
+}
+
+func TestManagerCompare(t *testing.T) {
+	policyBundle := func(revision, names string) *bundle.Bundle {
+		modulePath := "policy/allow.rego"
+		mod := fmt.Sprintf(`package policy
+import rego.v1
+default allow := false
+allow if input.name in %s
+`, names)
+
+		return &bundle.Bundle{
+			Manifest: bundle.Manifest{
+				Revision: revision,
+			},
+			Data: map[string]interface{}{},
+			Modules: []bundle.ModuleFile{
+				{
+					URL:    modulePath,
+					Path:   modulePath,
+					Parsed: ast.MustParseModule(mod),
+					Raw:    []byte(mod),
+				},
+			},
+		}
+	}
+
+	bundles := map[string]*bundle.Bundle{
+		"/bundles/systems/old":      policyBundle("old-1", `{"alice", "bob"}`),
+		"/bundles/systems/migrated": policyBundle("migrated-1", `{"alice", "bob"}`),
+		"/bundles/systems/broken":   policyBundle("broken-1", `{"bob"}`),
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		b, ok := bundles[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*b)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	for _, ref := range []string{"old", "migrated", "broken"} {
+		err := m.Add(ctx, ref, config.OPA{
+			Source: config.Source{
+				Endpoint: testServer.URL,
+				Token:    "token",
+				SystemID: ref,
+			},
+		}, WaitForActivation(5*time.Second))
+		if err != nil {
+			t.Fatalf("unexpected error adding OPA: %s", err)
+		}
+		defer m.Delete(ctx, ref)
+	}
+
+	comparisons := m.Compare(ctx, []string{"old", "missing", "migrated", "broken"}, sdk.DecisionOptions{
+		Path: "/policy/allow",
+		Input: map[string]interface{}{
+			"name": "alice",
+		},
+	})
+
+	if len(comparisons) != 4 {
+		t.Fatalf("unexpected number of comparisons: %d", len(comparisons))
+	}
+
+	expected := []struct {
+		ref      string
+		result   interface{}
+		err      error
+		revision string
+		differs  bool
+	}{
+		{ref: "old", result: true, revision: "old-1"},
+		{ref: "missing", err: ErrNotFound},
+		{ref: "migrated", result: true, revision: "migrated-1"},
+		{ref: "broken", result: false, revision: "broken-1", differs: true},
+	}
+
+	for i, e := range expected {
+		c := comparisons[i]
+
+		if c.Ref != e.ref {
+			t.Fatalf("unexpected ref at %d: %s", i, c.Ref)
+		}
+
+		if e.err != nil {
+			if !errors.Is(c.Err, e.err) {
+				t.Fatalf("unexpected error for %s: %v", c.Ref, c.Err)
+			}
+			continue
+		}
+
+		if c.Err != nil {
+			t.Fatalf("unexpected error for %s: %s", c.Ref, c.Err)
+		}
+
+		if c.Result.Result != e.result {
+			t.Fatalf("unexpected result for %s: %v", c.Ref, c.Result.Result)
+		}
+
+		if c.Revisions["systems/"+c.Ref] != e.revision {
+			t.Fatalf("unexpected revisions for %s: %v", c.Ref, c.Revisions)
+		}
+
+		if c.Differs != e.differs {
+			t.Fatalf("unexpected differs for %s: %v", c.Ref, c.Differs)
+		}
+	}
+}
+
+func TestManagerSubscribe(t *testing.T) {
+	modulePath := "policy/allow.rego"
+
+	newBundle := func(name string) *bundle.Bundle {
+		mod := fmt.Sprintf(`package policy
+import rego.v1
+default allow := false
+allow if input.name == %q`, name)
+
+		return &bundle.Bundle{
+			Manifest: bundle.Manifest{
+				Revision: name,
+			},
+			Data: map[string]interface{}{},
+			Modules: []bundle.ModuleFile{
+				{
+					URL:    modulePath,
+					Path:   modulePath,
+					Parsed: ast.MustParseModule(mod),
+					Raw:    []byte(mod),
+				},
+			},
+		}
+	}
+
+	var bundleLock sync.Mutex
+	currentBundle := newBundle("alice")
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		bundleLock.Lock()
+		defer bundleLock.Unlock()
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*currentBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	events, unsubscribe := m.Subscribe("example")
+	defer unsubscribe()
+
+	cfg := config.OPA{
+		Source: config.Source{
+			SystemID: "example",
+			Token:    "token",
+			Endpoint: testServer.URL,
+			Trigger:  config.TriggerManual,
+		},
+	}
+
+	err := m.Add(ctx, "example", cfg, WaitForActivation(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example")
+
+	expectEvent := func(revision string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case event := <-events:
+				if event.Ref != "example" || event.Bundle != "systems/example" {
+					t.Fatalf("unexpected event: %+v", event)
+				}
+
+				if event.Revision == revision {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("expected event for revision %s", revision)
+			}
+		}
+	}
+
+	expectEvent("alice")
+
+	bundleLock.Lock()
+	currentBundle = newBundle("bob")
+	bundleLock.Unlock()
+
+	err = m.Refresh(ctx, "example")
+	if err != nil {
+		t.Fatalf("unexpected error refreshing OPA: %s", err)
+	}
+
+	expectEvent("bob")
+
+	// the new instance is only announced once it has been swapped in
+	bundleLock.Lock()
+	currentBundle = newBundle("charlie")
+	bundleLock.Unlock()
+
+	err = m.Update(ctx, "example", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error updating OPA: %s", err)
+	}
+
+	expectEvent("charlie")
+
+	unsubscribe()
+
+	bundleLock.Lock()
+	currentBundle = newBundle("diane")
+	bundleLock.Unlock()
+
+	err = m.Refresh(ctx, "example")
+	if err != nil {
+		t.Fatalf("unexpected error refreshing OPA: %s", err)
+	}
+
+	// drain events published before unsubscribing
+	for {
+		select {
+		case event := <-events:
+			if event.Revision == "diane" {
+				t.Fatalf("unexpected event after unsubscribing: %+v", event)
+			}
+			continue
+		case <-time.After(500 * time.Millisecond):
+		}
+		break
+	}
+}
+
+func TestManagerDecisionLogs(t *testing.T) {
+	modulePath := "policy/allow.rego"
+	mod := `package policy
+import rego.v1
+default allow := false
+allow if input.name in {"alice", "bob"}
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Data: map[string]interface{}{},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(mod),
+				Raw:    []byte(mod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	logPath := filepath.Join(t.TempDir(), "decisions.jsonl")
+
+	cfg := config.OPA{
+		Source: config.Source{
+			Endpoint: testServer.URL,
+			Token:    "token",
+			SystemID: "example",
+		},
+		DecisionLogs: config.DecisionLogs{
+			Size: 2,
+			Path: logPath,
+		},
+	}
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	err := m.Add(ctx, "example", cfg, WaitForActivation(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example")
+
+	for _, name := range []string{"alice", "bob", "mallory"} {
+		_, err = m.Decision(ctx, "example", sdk.DecisionOptions{
+			Path:  "/policy/allow",
+			Input: map[string]interface{}{"name": name},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error making decision: %s", err)
+		}
+	}
+
+	_, err = m.Decision(ctx, "example", sdk.DecisionOptions{
+		Path: "/policy/missing",
+	})
+	if !sdk.IsUndefinedErr(err) {
+		t.Fatalf("expected undefined decision, got: %v", err)
+	}
+
+	decisions, err := m.Decisions("example")
+	if err != nil {
+		t.Fatalf("unexpected error listing decisions: %s", err)
+	}
+
+	if len(decisions) != 2 {
+		t.Fatalf("unexpected number of decisions: %d", len(decisions))
+	}
+
+	if !decisions[0].Undefined || decisions[0].Path != "/policy/missing" {
+		t.Fatalf("unexpected latest decision: %+v", decisions[0])
+	}
+
+	mallory := decisions[1]
+	if !reflect.DeepEqual(mallory.Input, map[string]interface{}{"name": "mallory"}) {
+		t.Fatalf("unexpected input: %v", mallory.Input)
+	}
+
+	if mallory.Result != false {
+		t.Fatalf("unexpected result: %v", mallory.Result)
+	}
+
+	if mallory.Revision() != "systems/example@1" {
+		t.Fatalf("unexpected revision: %s", mallory.Revision())
+	}
+
+	if mallory.Latency <= 0 || mallory.Timestamp.IsZero() {
+		t.Fatalf("expected latency and timestamp to be set: %+v", mallory)
+	}
+
+	// decisions made before an update are kept by the new instance
+	err = m.Update(ctx, "example", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error updating OPA: %s", err)
+	}
+
+	updated, err := m.Decisions("example")
+	if err != nil {
+		t.Fatalf("unexpected error listing decisions: %s", err)
+	}
+
+	if !reflect.DeepEqual(updated, decisions) {
+		t.Fatalf("unexpected decisions after update: %+v", updated)
+	}
+
+	bs, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("unexpected error reading decision log file: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("unexpected number of logged decisions: %d", len(lines))
+	}
+
+	var logged DecisionLog
+	err = json.Unmarshal([]byte(lines[0]), &logged)
+	if err != nil {
+		t.Fatalf("unexpected error decoding logged decision: %s", err)
+	}
+
+	if logged.Result != true || logged.Revisions["systems/example"] != "1" {
+		t.Fatalf("unexpected logged decision: %+v", logged)
+	}
+
+	_, err = m.Decisions("missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestManagerMetrics(t *testing.T) {
+	modulePath := "policy/allow.rego"
+	mod := `package policy
+import rego.v1
+allow if input.name == "alice"
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Data: map[string]interface{}{},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(mod),
+				Raw:    []byte(mod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	reg := prometheus.NewRegistry()
+
+	m := NewManager(WithMetrics(reg))
+
+	ctx := context.Background()
+
+	err := m.Add(ctx, "example", config.OPA{
+		Source: config.Source{
+			Endpoint: testServer.URL,
+			Token:    "token",
+			SystemID: "example",
+			Trigger:  config.TriggerManual,
+		},
+	}, WaitForActivation(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	for _, name := range []string{"alice", "bob"} {
+		_, err = m.Decision(ctx, "example", sdk.DecisionOptions{
+			Path:  "/policy/allow",
+			Input: map[string]interface{}{"name": name},
+		})
+		if err != nil && !sdk.IsUndefinedErr(err) {
+			t.Fatalf("unexpected error making decision: %s", err)
+		}
+	}
+
+	// bundle status is reported after the instance is ready, so the bundle
+	// metrics may take a moment to show up
+	var values map[string]float64
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		values = gatherMetrics(t, reg)
+		if values[`opa_manager_bundle_activations_total{bundle="systems/example",ref="example"}`] == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expected := map[string]float64{
+		`opa_manager_decisions_total{outcome="defined",ref="example"}`:                 1,
+		`opa_manager_decisions_total{outcome="undefined",ref="example"}`:               1,
+		`opa_manager_bundle_downloads_total{bundle="systems/example",ref="example"}`:   1,
+		`opa_manager_bundle_activations_total{bundle="systems/example",ref="example"}`: 1,
+		`opa_manager_ready{ref="example"}`:                                             1,
+	}
+
+	for name, value := range expected {
+		if values[name] != value {
+			t.Fatalf("unexpected value for %s: %v", name, values)
+		}
+	}
+
+	if values[`opa_manager_bundle_last_successful_activation_timestamp_seconds{bundle="systems/example",ref="example"}`] == 0 {
+		t.Fatalf("expected last activation timestamp to be set: %v", values)
+	}
+
+	err = m.Delete(ctx, "example")
+	if err != nil {
+		t.Fatalf("unexpected error deleting OPA: %s", err)
+	}
+
+	for name := range gatherMetrics(t, reg) {
+		if strings.Contains(name, `ref="example"`) {
+			t.Fatalf("unexpected metric after delete: %s", name)
+		}
+	}
+}
+
+// gatherMetrics returns the values of the counters and gauges in reg by
+// their name and labels.
+func gatherMetrics(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error gathering metrics: %s", err)
+	}
+
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make([]string, 0, len(metric.GetLabel()))
+			for _, l := range metric.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+
+			name := family.GetName() + "{" + strings.Join(labels, ",") + "}"
+
+			switch {
+			case metric.GetCounter() != nil:
+				values[name] = metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				values[name] = metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				values[name] = float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	return values
+}
+
+func TestDecisionRecorder(t *testing.T) {
+	r, err := newDecisionRecorder(config.DecisionLogs{Size: 3})
+	if err != nil {
+		t.Fatalf("unexpected error creating recorder: %s", err)
+	}
+
+	// the buffer grows as decisions are made rather than up front
+	if cap(r.decisions) != 0 {
+		t.Fatalf("expected no decisions to be allocated, got %d", cap(r.decisions))
+	}
+
+	ids := func() []string {
+		var ids []string
+		for _, d := range r.list() {
+			ids = append(ids, d.ID)
+		}
+		return ids
+	}
+
+	r.record(DecisionLog{ID: "1"})
+	r.record(DecisionLog{ID: "2"})
+
+	if got := ids(); !reflect.DeepEqual(got, []string{"2", "1"}) {
+		t.Fatalf("unexpected decisions: %v", got)
+	}
+
+	r.record(DecisionLog{ID: "3"})
+	r.record(DecisionLog{ID: "4"})
+
+	if got := ids(); !reflect.DeepEqual(got, []string{"4", "3", "2"}) {
+		t.Fatalf("unexpected decisions: %v", got)
+	}
+
+	// registrations may not keep more decisions in memory than the maximum
+	m := NewManager()
+	err = m.Add(context.Background(), "example", config.OPA{
+		Source: config.Source{
+			SystemID: "example",
+			Token:    "example-token",
+			Endpoint: "127.0.0.1:1",
+		},
+		DecisionLogs: config.DecisionLogs{Size: config.MaxDecisionLogSize + 1},
+	})
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("expected invalid config error, got %v", err)
+	}
+}
+
+func TestDecisionRecorderClose(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "decisions.jsonl")
+
+	r, err := newDecisionRecorder(config.DecisionLogs{Size: 3, Path: logPath})
+	if err != nil {
+		t.Fatalf("unexpected error creating recorder: %s", err)
+	}
+
+	r.record(DecisionLog{ID: "1"})
+	r.close()
+
+	// decisions in flight when an instance is replaced are recorded after
+	// its recorder is closed, they are only kept in memory
+	r.record(DecisionLog{ID: "2"})
+	r.close()
+
+	if r.file != nil {
+		t.Fatalf("expected the file to be released when closed")
+	}
+
+	if got := len(r.list()); got != 2 {
+		t.Fatalf("unexpected number of decisions: %d", got)
+	}
+
+	bs, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("unexpected error reading decision log: %s", err)
+	}
+
+	if lines := strings.Count(string(bs), "\n"); lines != 1 {
+		t.Fatalf("unexpected number of logged decisions: %d", lines)
+	}
+}
+
+func TestDecisionCache(t *testing.T) {
+	c := newDecisionCache(2)
+
+	for _, key := range []string{"a", "b"} {
+		entry, generation := c.get(key)
+		if entry != nil {
+			t.Fatalf("unexpected cached entry for %s", key)
+		}
+		c.add(generation, &cacheEntry{key: key, result: &sdk.DecisionResult{Result: key}})
+	}
+
+	// a is now the most recently used, so adding c evicts b
+	entry, generation := c.get("a")
+	if entry == nil || entry.result.Result != "a" {
+		t.Fatalf("unexpected cached entry for a: %+v", entry)
+	}
+	c.add(generation, &cacheEntry{key: "c", result: &sdk.DecisionResult{Result: "c"}})
+
+	if entry, _ := c.get("b"); entry != nil {
+		t.Fatalf("expected b to have been evicted")
+	}
+
+	// a decision evaluated before an invalidation must not be cached
+	_, generation = c.get("d")
+	c.invalidate()
+	c.add(generation, &cacheEntry{key: "d", result: &sdk.DecisionResult{Result: "d"}})
+
+	if entry, _ := c.get("d"); entry != nil {
+		t.Fatalf("expected d not to be cached after invalidation")
+	}
+
+	stats := c.getStats()
+	exp := CacheStats{
+		Size:          0,
+		Capacity:      2,
+		Hits:          1,
+		Misses:        5,
+		Evictions:     1,
+		Invalidations: 1,
+	}
+	if stats != exp {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestManagerDecisionCache(t *testing.T) {
+	modulePath := "policy/allow.rego"
+
+	newBundle := func(name string) *bundle.Bundle {
+		mod := fmt.Sprintf(`package policy
+import rego.v1
+default allow := false
+allow if input.name == %q`, name)
+
+		return &bundle.Bundle{
+			Manifest: bundle.Manifest{
+				Revision: name,
+			},
+			Modules: []bundle.ModuleFile{
+				{
+					URL:    modulePath,
+					Path:   modulePath,
+					Parsed: ast.MustParseModule(mod),
+					Raw:    []byte(mod),
+				},
+			},
+		}
+	}
+
+	var bundleLock sync.Mutex
+	currentBundle := newBundle("alice")
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		bundleLock.Lock()
+		defer bundleLock.Unlock()
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		w.Header().Set("etag", currentBundle.Manifest.Revision)
+		err := bundle.NewWriter(w).Write(*currentBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	err := m.Add(ctx, "example", config.OPA{
+		Source: config.Source{
+			SystemID: "example",
+			Token:    "example-token",
+			Endpoint: testServer.URL,
+			Trigger:  config.TriggerManual,
+		},
+		Cache: config.Cache{Size: 10},
+	}, WaitForActivation(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example")
+
+	var ids []string
+	decide := func(name string) interface{} {
+		dr, err := m.Decision(ctx, "example", sdk.DecisionOptions{
+			Path:  "/policy/allow",
+			Input: map[string]interface{}{"name": name},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error making decision: %s", err)
+		}
+
+		ids = append(ids, dr.ID)
+
+		return dr.Result
+	}
+
+	for i := 0; i < 3; i++ {
+		if decide("alice") != true {
+			t.Fatalf("expected alice to be allowed")
+		}
+	}
+
+	stats := m.Status("example").Cache
+	if stats == nil {
+		t.Fatalf("expected cache stats to be present")
+	}
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Size != 1 {
+		t.Fatalf("unexpected cache stats: %+v", stats)
+	}
+
+	// decisions served from the cache are logged too
+	decisions, err := m.Decisions("example")
+	if err != nil {
+		t.Fatalf("unexpected error listing decisions: %s", err)
+	}
+
+	cached := 0
+	for _, d := range decisions {
+		if d.Cached {
+			cached++
+
+			if d.Path != "/policy/allow" || d.Result != true || d.Revision() == "" {
+				t.Fatalf("unexpected cached decision: %+v", d)
+			}
+		}
+	}
+	if len(decisions) != 3 || cached != 2 {
+		t.Fatalf("unexpected decisions: %+v", decisions)
+	}
+
+	// each decision has its own ID, which is the one it was logged under
+	logged := map[string]bool{}
+	for _, d := range decisions {
+		logged[d.ID] = true
+	}
+	returned := map[string]bool{}
+	for _, id := range ids {
+		if id == "" || returned[id] || !logged[id] {
+			t.Fatalf("unexpected decision IDs: %v, logged: %+v", ids, decisions)
+		}
+		returned[id] = true
+	}
+
+	bundleLock.Lock()
+	currentBundle = newBundle("bob")
+	bundleLock.Unlock()
+
+	err = m.Refresh(ctx, "example")
+	if err != nil {
+		t.Fatalf("unexpected error refreshing OPA: %s", err)
+	}
+
+	// the cached decision for alice must not be served once bob's bundle is
+	// active
+	if decide("alice") != false {
+		t.Fatalf("expected alice to be denied after the bundle was activated")
+	}
+	if decide("bob") != true {
+		t.Fatalf("expected bob to be allowed after the bundle was activated")
+	}
+
+	stats = m.Status("example").Cache
+	if stats.Invalidations == 0 {
+		t.Fatalf("expected the cache to have been invalidated: %+v", stats)
+	}
+}
+
+func TestManagerSecretFileRotation(t *testing.T) {
+	modulePath := "policy/allow.rego"
+
+	newBundle := func(name string) *bundle.Bundle {
+		mod := fmt.Sprintf(`package policy
+import rego.v1
+default allow := false
+allow if input.name == %q`, name)
+
+		return &bundle.Bundle{
+			Manifest: bundle.Manifest{
+				Revision: name,
+			},
+			Modules: []bundle.ModuleFile{
+				{
+					URL:    modulePath,
+					Path:   modulePath,
+					Parsed: ast.MustParseModule(mod),
+					Raw:    []byte(mod),
+				},
+			},
+		}
+	}
+
+	// each token is served a different bundle, so decisions show which
+	// token the OPA is using
+	bundles := map[string]*bundle.Bundle{
+		"Bearer token-1": newBundle("alice"),
+		"Bearer token-2": newBundle("bob"),
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		b, ok := bundles[r.Header.Get("Authorization")]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*b)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenPath, []byte("token-1\n"), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error writing token file: %s", err)
+	}
+
+	m := NewManager()
+
+	ctx := context.Background()
+
+	cfg := config.OPA{
+		Source: config.Source{
+			SystemID: "example",
+			Token:    "file:" + tokenPath,
+			Endpoint: testServer.URL,
+		},
+	}
+
+	err = m.Add(ctx, "example", cfg, WaitForActivation(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example")
+
+	if got := m.Config("example").Token; got != cfg.Token {
+		t.Fatalf("expected the registration to keep the secret reference, got %q", got)
+	}
+
+	allowed := func(name string) bool {
+		dr, err := m.Decision(ctx, "example", sdk.DecisionOptions{
+			Path:  "/policy/allow",
+			Input: map[string]interface{}{"name": name},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error making decision: %s", err)
+		}
+
+		return dr.Result == true
+	}
+
+	if !allowed("alice") {
+		t.Fatalf("expected alice to be allowed with the first token")
+	}
+
+	err = os.WriteFile(tokenPath, []byte("token-2\n"), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error writing token file: %s", err)
+	}
+
+	retries := 50
+	for !allowed("bob") {
+		retries--
+		if retries == 0 {
+			t.Fatalf("expected bob to be allowed once the token was rotated")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestWatchPathSymlinkSwap(t *testing.T) {
+	// the layout Kubernetes uses for mounted secrets, where token links to
+	// ..data/token and ..data is swapped to rotate all the files at once
+	dir := t.TempDir()
+
+	writeVersion := func(version, token string) {
+		err := os.Mkdir(filepath.Join(dir, version), 0o700)
+		if err != nil {
+			t.Fatalf("unexpected error creating version directory: %s", err)
+		}
+
+		err = os.WriteFile(filepath.Join(dir, version, "token"), []byte(token), 0o600)
+		if err != nil {
+			t.Fatalf("unexpected error writing token file: %s", err)
+		}
+	}
+
+	writeVersion("..v1", "token-1")
+
+	for link, target := range map[string]string{
+		"..data": "..v1",
+		"token":  "..data/token",
+	} {
+		err := os.Symlink(target, filepath.Join(dir, link))
+		if err != nil {
+			t.Fatalf("unexpected error creating symlink: %s", err)
+		}
+	}
+
+	changes := make(chan struct{}, 10)
+	fw, err := watchPath(filepath.Join(dir, "token"), func() {
+		changes <- struct{}{}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error watching token: %s", err)
+	}
+	defer fw.stop()
+
+	writeVersion("..v2", "token-2")
+
+	err = os.Symlink("..v2", filepath.Join(dir, "..data_tmp"))
+	if err != nil {
+		t.Fatalf("unexpected error creating symlink: %s", err)
+	}
+
+	err = os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))
+	if err != nil {
+		t.Fatalf("unexpected error swapping symlink: %s", err)
+	}
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the symlink swap to be seen as a change")
+	}
+}
+
+func TestAddMissingSecret(t *testing.T) {
+	m := NewManager()
+
+	err := m.Add(context.Background(), "example", config.OPA{
+		Source: config.Source{
+			SystemID: "example",
+			Token:    "${DEMO_TEST_MISSING_TOKEN}",
+			Endpoint: "http://localhost:8181",
+		},
+	})
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("expected invalid config error, got %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package opa
+
+import (
+	"time"
+
+	"github.com/open-policy-agent/opa/sdk"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsNamespace prefixes the names of the metrics of the Manager.
+const metricsNamespace = "opa_manager"
+
+// Decision outcomes used for the outcome label of the decisions counter.
+const (
+	outcomeDefined   = "defined"
+	outcomeUndefined = "undefined"
+	outcomeError     = "error"
+)
+
+// managerMetrics holds the metrics recorded as OPAs make decisions and
+// activate bundles. All methods are no-ops on a nil *managerMetrics so that
+// metrics are optional.
+type managerMetrics struct {
+	decisions        *prometheus.CounterVec
+	decisionDuration *prometheus.HistogramVec
+
+	bundleDownloads   *prometheus.CounterVec
+	bundleActivations *prometheus.CounterVec
+}
+
+// WithMetrics registers the metrics of the Manager with reg.
+func WithMetrics(reg prometheus.Registerer) func(*Manager) {
+	return func(m *Manager) {
+		m.metrics = &managerMetrics{
+			decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "decisions_total",
+				Help:      "Decisions made by each OPA by outcome.",
+			}, []string{"ref", "outcome"}),
+			decisionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Name:      "decision_duration_seconds",
+				Help:      "Time taken by each OPA to make decisions.",
+				Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+			}, []string{"ref"}),
+			bundleDownloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "bundle_downloads_total",
+				Help:      "Successful bundle downloads of each OPA.",
+			}, []string{"ref", "bundle"}),
+			bundleActivations: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "bundle_activations_total",
+				Help:      "Bundle activations of each OPA.",
+			}, []string{"ref", "bundle"}),
+		}
+
+		reg.MustRegister(
+			m.metrics.decisions,
+			m.metrics.decisionDuration,
+			m.metrics.bundleDownloads,
+			m.metrics.bundleActivations,
+			&statusCollector{manager: m},
+		)
+	}
+}
+
+func (mm *managerMetrics) observeDecision(ref string, duration time.Duration, err error) {
+	if mm == nil {
+		return
+	}
+
+	outcome := outcomeDefined
+	switch {
+	case err == nil:
+	case sdk.IsUndefinedErr(err):
+		outcome = outcomeUndefined
+	default:
+		outcome = outcomeError
+	}
+
+	mm.decisions.WithLabelValues(ref, outcome).Inc()
+	mm.decisionDuration.WithLabelValues(ref).Observe(duration.Seconds())
+}
+
+func (mm *managerMetrics) observeDownload(ref string, b BundleStatus) {
+	if mm == nil {
+		return
+	}
+
+	mm.bundleDownloads.WithLabelValues(ref, b.Name).Inc()
+}
+
+func (mm *managerMetrics) observeActivation(ref string, b BundleStatus) {
+	if mm == nil {
+		return
+	}
+
+	mm.bundleActivations.WithLabelValues(ref, b.Name).Inc()
+}
+
+// delete removes the metrics of ref once it has been deleted.
+func (mm *managerMetrics) delete(ref string) {
+	if mm == nil {
+		return
+	}
+
+	labels := prometheus.Labels{"ref": ref}
+
+	mm.decisions.DeletePartialMatch(labels)
+	mm.decisionDuration.DeletePartialMatch(labels)
+	mm.bundleDownloads.DeletePartialMatch(labels)
+	mm.bundleActivations.DeletePartialMatch(labels)
+}
+
+var (
+	readyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "ready"),
+		"Whether each OPA has activated its bundles.",
+		[]string{"ref"}, nil,
+	)
+	lastDownloadDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "bundle", "last_successful_download_timestamp_seconds"),
+		"Time of the last successful download of each bundle.",
+		[]string{"ref", "bundle"}, nil,
+	)
+	lastActivationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "bundle", "last_successful_activation_timestamp_seconds"),
+		"Time of the last successful activation of each bundle.",
+		[]string{"ref", "bundle"}, nil,
+	)
+)
+
+// statusCollector reports the bundle status of the OPAs registered when
+// metrics are gathered.
+type statusCollector struct {
+	manager *Manager
+}
+
+func (c *statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- readyDesc
+	ch <- lastDownloadDesc
+	ch <- lastActivationDesc
+}
+
+func (c *statusCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, ref := range c.manager.List() {
+		status := c.manager.Status(ref)
+		if status == nil {
+			continue
+		}
+
+		ready := 0.0
+		if status.Ready {
+			ready = 1
+		}
+		ch <- prometheus.MustNewConstMetric(readyDesc, prometheus.GaugeValue, ready, ref)
+
+		for _, b := range status.Bundles {
+			if !b.LastSuccessfulDownload.IsZero() {
+				ch <- prometheus.MustNewConstMetric(
+					lastDownloadDesc, prometheus.GaugeValue,
+					float64(b.LastSuccessfulDownload.UnixNano())/1e9, ref, b.Name,
+				)
+			}
+
+			if !b.LastSuccessfulActivation.IsZero() {
+				ch <- prometheus.MustNewConstMetric(
+					lastActivationDesc, prometheus.GaugeValue,
+					float64(b.LastSuccessfulActivation.UnixNano())/1e9, ref, b.Name,
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package opa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+)
+
+// sdkConfig is the subset of the OPA configuration file used to configure
+// instances created by the Manager.
+type sdkConfig struct {
+	PersistenceDirectory string `json:"persistence_directory,omitempty"`
+
+	Services map[string]sdkService `json:"services"`
+	Bundles  map[string]sdkBundle  `json:"bundles"`
+	Keys     map[string]sdkKey     `json:"keys,omitempty"`
+	Plugins  map[string]struct{}   `json:"plugins"`
+	Status   sdkStatus             `json:"status"`
+
+	DecisionLogs sdkDecisionLogs `json:"decision_logs"`
+}
+
+type sdkStatus struct {
+	Plugin string `json:"plugin"`
+}
+
+type sdkDecisionLogs struct {
+	Plugin string `json:"plugin"`
+}
+
+type sdkService struct {
+	URL         string          `json:"url"`
+	Type        string          `json:"type,omitempty"`
+	Credentials *sdkCredentials `json:"credentials,omitempty"`
+}
+
+type sdkCredentials struct {
+	Bearer *sdkBearer `json:"bearer,omitempty"`
+}
+
+type sdkBearer struct {
+	Token  string `json:"token"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+type sdkBundle struct {
+	Service  string      `json:"service"`
+	Resource string      `json:"resource"`
+	Trigger  string      `json:"trigger,omitempty"`
+	Polling  sdkPolling  `json:"polling"`
+	Signing  *sdkSigning `json:"signing,omitempty"`
+}
+
+type sdkSigning struct {
+	KeyID string `json:"keyid"`
+	Scope string `json:"scope,omitempty"`
+}
+
+type sdkKey struct {
+	Key       string `json:"key"`
+	Algorithm string `json:"algorithm"`
+	Scope     string `json:"scope,omitempty"`
+}
+
+type sdkPolling struct {
+	MinDelaySeconds           int64 `json:"min_delay_seconds"`
+	MaxDelaySeconds           int64 `json:"max_delay_seconds"`
+	LongPollingTimeoutSeconds int64 `json:"long_polling_timeout_seconds,omitempty"`
+}
+
+// defaultPollingDelaySeconds is used for the min and max delay when they are
+// not set, it is low so that updates show up quickly in demos.
+const defaultPollingDelaySeconds = 1
+
+// buildSDKConfig returns the OPA configuration for an instance loading the
+// bundles of cfg. The persistence directory is where OCI bundles are stored
+// while being pulled, it is unused for other sources.
+func buildSDKConfig(cfg config.OPA, persistenceDir string) ([]byte, error) {
+	c := sdkConfig{
+		PersistenceDirectory: persistenceDir,
+		Services:             map[string]sdkService{},
+		Bundles:              map[string]sdkBundle{},
+		Keys:                 map[string]sdkKey{},
+		Plugins: map[string]struct{}{
+			statusPluginName:      {},
+			decisionLogPluginName: {},
+		},
+		Status: sdkStatus{
+			Plugin: statusPluginName,
+		},
+		DecisionLogs: sdkDecisionLogs{
+			Plugin: decisionLogPluginName,
+		},
+	}
+
+	for i, b := range cfg.Sources() {
+		err := c.addSource(fmt.Sprintf("bundles-%d", i), b.Name, b.Source)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("bundles[%d]: %w", i-1, err)
+		}
+	}
+
+	return json.Marshal(c)
+}
+
+// addSource adds the bundle for source, along with the service it is
+// downloaded from if it needs one. The bundle name is derived from the source
+// when name is empty.
+func (c *sdkConfig) addSource(serviceName, name string, source config.Source) error {
+	polling, err := buildPolling(source.Polling)
+	if err != nil {
+		return err
+	}
+
+	switch source.Trigger {
+	case config.TriggerPeriodic, config.TriggerManual, "":
+	default:
+		return fmt.Errorf("unknown trigger %q", source.Trigger)
+	}
+
+	b := sdkBundle{
+		Trigger: source.Trigger,
+		Polling: polling,
+	}
+
+	if source.Verification.Enabled() {
+		b.Signing, err = c.addKey(source.Verification)
+		if err != nil {
+			return err
+		}
+	}
+
+	var defaultName string
+	switch source.Kind {
+	case config.SourceKindDAS, "":
+		if source.SystemID == "" {
+			return fmt.Errorf("system_id must be provided for %s sources", config.SourceKindDAS)
+		}
+
+		defaultName = "systems/" + source.SystemID
+		b.Resource = "/bundles/systems/" + source.SystemID
+	case config.SourceKindHTTP:
+		if source.Resource == "" {
+			return fmt.Errorf("resource must be provided for %s sources", config.SourceKindHTTP)
+		}
+
+		defaultName = strings.Trim(source.Resource, "/")
+		b.Resource = "/" + defaultName
+	case config.SourceKindFile:
+		if source.Path == "" {
+			return fmt.Errorf("path must be provided for %s sources", config.SourceKindFile)
+		}
+
+		path, err := filepath.Abs(source.Path)
+		if err != nil {
+			return fmt.Errorf("invalid path: %w", err)
+		}
+
+		defaultName = filepath.Base(path)
+		b.Resource = (&url.URL{Scheme: "file", Path: path}).String()
+	case config.SourceKindOCI:
+		if source.Reference == "" {
+			return fmt.Errorf("reference must be provided for %s sources", config.SourceKindOCI)
+		}
+
+		if source.Endpoint == "" {
+			registry, _, _ := strings.Cut(source.Reference, "/")
+			source.Endpoint = "https://" + registry
+		}
+
+		defaultName = source.Reference
+		b.Resource = source.Reference
+	default:
+		return fmt.Errorf("unknown source kind %q", source.Kind)
+	}
+
+	if name == "" {
+		name = defaultName
+	}
+
+	if _, ok := c.Bundles[name]; ok {
+		return fmt.Errorf("bundle name %q is used more than once", name)
+	}
+
+	// file bundles are read directly by the bundle plugin, so there is no
+	// service to configure
+	if source.Kind != config.SourceKindFile {
+		service, err := buildService(source)
+		if err != nil {
+			return err
+		}
+
+		b.Service = serviceName
+		c.Services[b.Service] = service
+	}
+
+	c.Bundles[name] = b
+
+	return nil
+}
+
+// addKey adds the verification key and returns the signing config of
+// bundles verified with it.
+func (c *sdkConfig) addKey(v config.Verification) (*sdkSigning, error) {
+	if v.KeyID == "" {
+		return nil, fmt.Errorf("verification key_id must be provided")
+	}
+
+	key := sdkKey{
+		Algorithm: v.Algorithm,
+		Scope:     v.Scope,
+	}
+
+	switch {
+	case v.PublicKey != "" && v.Secret != "":
+		return nil, fmt.Errorf("only one of verification public_key or secret may be provided")
+	case v.PublicKey != "":
+		key.Key = v.PublicKey
+		if key.Algorithm == "" {
+			key.Algorithm = "RS256"
+		}
+	case v.Secret != "":
+		key.Key = v.Secret
+		if key.Algorithm == "" {
+			key.Algorithm = "HS256"
+		}
+	default:
+		return nil, fmt.Errorf("verification public_key or secret must be provided")
+	}
+
+	if existing, ok := c.Keys[v.KeyID]; ok && existing != key {
+		return nil, fmt.Errorf("verification key_id %q is used for different keys", v.KeyID)
+	}
+
+	c.Keys[v.KeyID] = key
+
+	return &sdkSigning{
+		KeyID: v.KeyID,
+		Scope: v.Scope,
+	}, nil
+}
+
+func buildService(source config.Source) (sdkService, error) {
+	if source.Endpoint == "" {
+		return sdkService{}, fmt.Errorf("endpoint must be provided")
+	}
+
+	endpoint := source.Endpoint
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "http://" + endpoint
+	}
+
+	service := sdkService{URL: endpoint}
+
+	switch {
+	case source.Kind == config.SourceKindOCI && source.Username != "":
+		// the bearer token of oci services is base64 encoded by OPA, which
+		// makes a Basic scheme token valid basic authentication
+		service.Credentials = &sdkCredentials{
+			Bearer: &sdkBearer{
+				Token:  source.Username + ":" + source.Password,
+				Scheme: "Basic",
+			},
+		}
+	case source.Token != "":
+		service.Credentials = &sdkCredentials{
+			Bearer: &sdkBearer{Token: source.Token},
+		}
+	}
+
+	if source.Kind == config.SourceKindOCI {
+		service.Type = "oci"
+	}
+
+	return service, nil
+}
+
+func buildPolling(polling config.Polling) (sdkPolling, error) {
+	p := sdkPolling{
+		MinDelaySeconds:           polling.MinDelaySeconds,
+		MaxDelaySeconds:           polling.MaxDelaySeconds,
+		LongPollingTimeoutSeconds: polling.LongPollingTimeoutSeconds,
+	}
+
+	if p.MinDelaySeconds < 0 || p.MaxDelaySeconds < 0 || p.LongPollingTimeoutSeconds < 0 {
+		return p, fmt.Errorf("polling settings must not be negative")
+	}
+
+	if p.MinDelaySeconds == 0 {
+		p.MinDelaySeconds = defaultPollingDelaySeconds
+	}
+
+	if p.MaxDelaySeconds == 0 {
+		p.MaxDelaySeconds = max(p.MinDelaySeconds, defaultPollingDelaySeconds)
+	}
+
+	if p.MinDelaySeconds > p.MaxDelaySeconds {
+		return p, fmt.Errorf("min_delay_seconds must not be greater than max_delay_seconds")
+	}
+
+	return p, nil
+}
@@ -0,0 +1,201 @@
+package opa
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/plugins/status"
+)
+
+// statusPluginName is the name of the plugin receiving status updates from
+// the status plugin of each instance.
+const statusPluginName = "demo_live_policy_update_status"
+
+// Status summarises the state of the bundles loaded by an OPA instance.
+type Status struct {
+	// Ready is true once all bundles have been activated.
+	Ready   bool
+	Bundles []BundleStatus
+
+	// Cache holds the decision cache statistics, it is nil when decisions
+	// are not cached.
+	Cache *CacheStats
+}
+
+// BundleStatus is the last reported state of a single bundle.
+type BundleStatus struct {
+	Name                     string
+	ActiveRevision           string
+	LastRequest              time.Time
+	LastSuccessfulRequest    time.Time
+	LastSuccessfulDownload   time.Time
+	LastSuccessfulActivation time.Time
+	HTTPCode                 string
+	Code                     string
+	Message                  string
+	Errors                   []string
+
+	// SignatureRejected is true when the last bundle downloaded was rejected
+	// because its signature could not be verified.
+	SignatureRejected bool
+}
+
+// signatureErrors are fragments of the errors OPA reports when a bundle
+// fails signature verification, OPA does not expose typed errors for these.
+var signatureErrors = []string{
+	"signature",
+	"failed to verify",
+	"verification key",
+	"digest mismatch",
+	"scope mismatch",
+}
+
+func isSignatureError(message string) bool {
+	for _, fragment := range signatureErrors {
+		if strings.Contains(message, fragment) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// statusRecorder holds the latest status reported by an instance.
+type statusRecorder struct {
+	lock   sync.RWMutex
+	status Status
+
+	// onActivation is called with the status of each bundle which has been
+	// activated since the previous update.
+	onActivation func(BundleStatus)
+
+	// onDownload is called with the status of each bundle which has been
+	// downloaded since the previous update.
+	onDownload func(BundleStatus)
+
+	// activated is closed once the status of expected bundles shows they
+	// have been activated, it is optional.
+	activated     chan struct{}
+	activatedOnce sync.Once
+	expected      int
+}
+
+func (r *statusRecorder) update(req *status.UpdateRequestV1) {
+	bundles := make([]BundleStatus, 0, len(req.Bundles))
+	for name, s := range req.Bundles {
+		if s == nil {
+			continue
+		}
+
+		bs := BundleStatus{
+			Name:                     name,
+			ActiveRevision:           s.ActiveRevision,
+			LastRequest:              s.LastRequest,
+			LastSuccessfulRequest:    s.LastSuccessfulRequest,
+			LastSuccessfulDownload:   s.LastSuccessfulDownload,
+			LastSuccessfulActivation: s.LastSuccessfulActivation,
+			HTTPCode:                 s.HTTPCode.String(),
+			Code:                     s.Code,
+			Message:                  s.Message,
+		}
+
+		for _, err := range s.Errors {
+			bs.Errors = append(bs.Errors, err.Error())
+		}
+
+		bs.SignatureRejected = s.Code != "" && isSignatureError(s.Message)
+
+		bundles = append(bundles, bs)
+	}
+
+	sort.Slice(bundles, func(i, j int) bool {
+		return bundles[i].Name < bundles[j].Name
+	})
+
+	r.lock.Lock()
+
+	previous := make(map[string]BundleStatus, len(r.status.Bundles))
+	for _, b := range r.status.Bundles {
+		previous[b.Name] = b
+	}
+
+	r.status.Bundles = bundles
+
+	r.lock.Unlock()
+
+	if r.activated != nil {
+		active := 0
+		for _, b := range bundles {
+			if !b.LastSuccessfulActivation.IsZero() {
+				active++
+			}
+		}
+
+		if active >= r.expected {
+			r.activatedOnce.Do(func() { close(r.activated) })
+		}
+	}
+
+	for _, b := range bundles {
+		if r.onDownload != nil && !b.LastSuccessfulDownload.IsZero() && !b.LastSuccessfulDownload.Equal(previous[b.Name].LastSuccessfulDownload) {
+			r.onDownload(b)
+		}
+
+		if r.onActivation != nil && !b.LastSuccessfulActivation.IsZero() && !b.LastSuccessfulActivation.Equal(previous[b.Name].LastSuccessfulActivation) {
+			r.onActivation(b)
+		}
+	}
+}
+
+func (r *statusRecorder) get() Status {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	s := r.status
+	s.Bundles = append([]BundleStatus(nil), r.status.Bundles...)
+
+	return s
+}
+
+// statusPluginFactory creates plugins which the OPA status plugin is
+// configured to hand its updates to.
+type statusPluginFactory struct {
+	recorder *statusRecorder
+}
+
+func (f *statusPluginFactory) Validate(_ *plugins.Manager, _ []byte) (interface{}, error) {
+	return nil, nil
+}
+
+func (f *statusPluginFactory) New(manager *plugins.Manager, _ interface{}) plugins.Plugin {
+	return &statusPlugin{
+		manager:  manager,
+		recorder: f.recorder,
+	}
+}
+
+type statusPlugin struct {
+	manager  *plugins.Manager
+	recorder *statusRecorder
+}
+
+func (p *statusPlugin) Start(_ context.Context) error {
+	p.manager.UpdatePluginStatus(statusPluginName, &plugins.Status{State: plugins.StateOK})
+	return nil
+}
+
+func (p *statusPlugin) Stop(_ context.Context) {
+	p.manager.UpdatePluginStatus(statusPluginName, &plugins.Status{State: plugins.StateNotReady})
+}
+
+func (p *statusPlugin) Reconfigure(_ context.Context, _ interface{}) {}
+
+// Log implements status.Logger.
+func (p *statusPlugin) Log(_ context.Context, req *status.UpdateRequestV1) error {
+	p.recorder.update(req)
+	return nil
+}
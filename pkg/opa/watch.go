@@ -0,0 +1,155 @@
+package opa
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce groups the bursts of events editors produce when saving a
+// file into a single reload.
+const watchDebounce = 100 * time.Millisecond
+
+// fileWatcher calls onChange when a watched directory or file changes.
+type fileWatcher struct {
+	watcher  *fsnotify.Watcher
+	path     string
+	isDir    bool
+	onChange func()
+	done     chan struct{}
+
+	// target is the file path resolves to, it is only used by loop once
+	// the watcher is started
+	target string
+}
+
+// watchPath starts watching path, which is either a directory that is
+// watched recursively, such as a bundle directory, or a single file.
+func watchPath(path string, onChange func()) (*fileWatcher, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+
+	fw := &fileWatcher{
+		watcher:  watcher,
+		path:     path,
+		isDir:    info.IsDir(),
+		onChange: onChange,
+		done:     make(chan struct{}),
+	}
+
+	if fw.isDir {
+		err = fw.addDir(path)
+	} else {
+		// editors often save by replacing the file, which would drop a watch
+		// on the file itself, so the parent directory is watched instead
+		fw.target, _ = filepath.EvalSymlinks(path)
+		err = watcher.Add(filepath.Dir(path))
+	}
+	if err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", path, err)
+	}
+
+	go fw.loop()
+
+	return fw, nil
+}
+
+func (fw *fileWatcher) addDir(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		return fw.watcher.Add(path)
+	})
+}
+
+func (fw *fileWatcher) loop() {
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-fw.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if !fw.isDir && !fw.fileChanged(event) {
+				continue
+			}
+
+			if fw.isDir && event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					err = fw.addDir(event.Name)
+					if err != nil {
+						log.Printf("failed to watch new directory %s: %s", event.Name, err)
+					}
+				}
+			}
+
+			timer.Reset(watchDebounce)
+		case err, ok := <-fw.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			log.Printf("error watching %s: %s", fw.path, err)
+		case <-timer.C:
+			fw.onChange()
+		case <-fw.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// fileChanged returns true if event changes the watched file. Secrets
+// mounted by Kubernetes, and others rotated by swapping a symlink, change a
+// link elsewhere in the directory rather than the file itself, so the file
+// is resolved again when links in the directory change to see whether it
+// now points to another file.
+func (fw *fileWatcher) fileChanged(event fsnotify.Event) bool {
+	if filepath.Clean(event.Name) == fw.path {
+		return true
+	}
+
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) && !event.Has(fsnotify.Remove) {
+		return false
+	}
+
+	target, err := filepath.EvalSymlinks(fw.path)
+	if err != nil || target == fw.target {
+		return false
+	}
+	fw.target = target
+
+	return true
+}
+
+func (fw *fileWatcher) stop() error {
+	close(fw.done)
+	return fw.watcher.Close()
+}
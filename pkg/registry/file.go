@@ -0,0 +1,239 @@
+package registry
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+)
+
+// KeySize is the length in bytes of the key used to encrypt registrations.
+const KeySize = 32
+
+// FileStore is a Store holding registrations in a JSON file. Each
+// registration is encrypted with AES-GCM so that tokens are not written to
+// disk in plain text, refs are stored in the clear.
+type FileStore struct {
+	path string
+	aead cipher.AEAD
+	lock sync.Mutex
+}
+
+type fileContents struct {
+	OPAs map[string]string `json:"opas"`
+}
+
+// NewFileStore returns a FileStore persisting registrations to path and
+// encrypting them with key, which must be KeySize bytes long.
+func NewFileStore(path string, key []byte) (*FileStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path must be provided")
+	}
+
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcm: %w", err)
+	}
+
+	return &FileStore{
+		path: path,
+		aead: aead,
+	}, nil
+}
+
+// ParseKey decodes a base64 encoded key, such as one generated with
+// `openssl rand -base64 32`.
+func ParseKey(encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, fmt.Errorf("key must be provided")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("key must be base64 encoded: %w", err)
+	}
+
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	return key, nil
+}
+
+func (s *FileStore) Load() (map[string]config.OPA, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	contents, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	opas := make(map[string]config.OPA, len(contents.OPAs))
+	for ref, sealed := range contents.OPAs {
+		cfg, err := s.open(ref, sealed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt registration %s: %w", ref, err)
+		}
+
+		opas[ref] = cfg
+	}
+
+	return opas, nil
+}
+
+func (s *FileStore) Put(ref string, cfg config.OPA) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	contents, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	sealed, err := s.seal(ref, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt registration %s: %w", ref, err)
+	}
+
+	contents.OPAs[ref] = sealed
+
+	return s.write(contents)
+}
+
+func (s *FileStore) Delete(ref string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	contents, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := contents.OPAs[ref]; !ok {
+		return nil
+	}
+
+	delete(contents.OPAs, ref)
+
+	return s.write(contents)
+}
+
+func (s *FileStore) read() (*fileContents, error) {
+	contents := &fileContents{}
+
+	bs, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		contents.OPAs = make(map[string]string)
+		return contents, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry file: %w", err)
+	}
+
+	err = json.Unmarshal(bs, contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registry file: %w", err)
+	}
+
+	if contents.OPAs == nil {
+		contents.OPAs = make(map[string]string)
+	}
+
+	return contents, nil
+}
+
+// write replaces the registry file via a rename so that a crash mid write
+// does not leave a truncated file behind.
+func (s *FileStore) write(contents *fileContents) error {
+	bs, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal registry: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create registry file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(bs)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write registry file: %w", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write registry file: %w", err)
+	}
+
+	err = os.Rename(f.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("failed to replace registry file: %w", err)
+	}
+
+	return nil
+}
+
+// seal encrypts the registration, using the ref as additional data so that
+// entries cannot be swapped between refs.
+func (s *FileStore) seal(ref string, cfg config.OPA) (string, error) {
+	plaintext, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := s.aead.Seal(nonce, nonce, plaintext, []byte(ref))
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *FileStore) open(ref, encoded string) (config.OPA, error) {
+	var cfg config.OPA
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return cfg, err
+	}
+
+	if len(sealed) < s.aead.NonceSize() {
+		return cfg, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(ref))
+	if err != nil {
+		return cfg, err
+	}
+
+	err = json.Unmarshal(plaintext, &cfg)
+
+	return cfg, err
+}
@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	key := bytes.Repeat([]byte("k"), KeySize)
+
+	store, err := NewFileStore(path, key)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %s", err)
+	}
+
+	opas, err := store.Load()
+	if err != nil {
+		t.Fatalf("unexpected error loading empty store: %s", err)
+	}
+	if len(opas) != 0 {
+		t.Fatalf("expected no registrations, got %d", len(opas))
+	}
+
+	example := config.OPA{
+		Source: config.Source{
+			Endpoint: "https://example.svc.styra.com/v1",
+			Token:    "super-secret-token",
+			SystemID: "example-system",
+		},
+		Bundles: []config.Bundle{
+			{
+				Name: "library",
+				Source: config.Source{
+					Kind:     config.SourceKindHTTP,
+					Endpoint: "https://bundles.example.com",
+					Resource: "library.tar.gz",
+				},
+			},
+		},
+	}
+
+	err = store.Put("example", example)
+	if err != nil {
+		t.Fatalf("unexpected error putting registration: %s", err)
+	}
+
+	err = store.Put("other", config.OPA{
+		Source: config.Source{
+			Kind:     config.SourceKindHTTP,
+			Endpoint: "https://bundles.example.com",
+			Resource: "/bundle.tar.gz",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting registration: %s", err)
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading registry file: %s", err)
+	}
+	if bytes.Contains(bs, []byte("super-secret-token")) {
+		t.Fatalf("expected token to be encrypted at rest")
+	}
+
+	// a new store simulates a restart of the server
+	store, err = NewFileStore(path, key)
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %s", err)
+	}
+
+	opas, err = store.Load()
+	if err != nil {
+		t.Fatalf("unexpected error loading store: %s", err)
+	}
+	if len(opas) != 2 {
+		t.Fatalf("expected 2 registrations, got %d", len(opas))
+	}
+	if !reflect.DeepEqual(opas["example"], example) {
+		t.Fatalf("unexpected example registration: %+v", opas["example"])
+	}
+
+	err = store.Delete("other")
+	if err != nil {
+		t.Fatalf("unexpected error deleting registration: %s", err)
+	}
+
+	opas, err = store.Load()
+	if err != nil {
+		t.Fatalf("unexpected error loading store: %s", err)
+	}
+	if _, ok := opas["other"]; ok {
+		t.Fatalf("expected other to be deleted")
+	}
+
+	wrongKeyStore, err := NewFileStore(path, bytes.Repeat([]byte("x"), KeySize))
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %s", err)
+	}
+
+	_, err = wrongKeyStore.Load()
+	if err == nil {
+		t.Fatalf("expected error loading with the wrong key")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	_, err := ParseKey("")
+	if err == nil {
+		t.Fatalf("expected error for empty key")
+	}
+
+	_, err = ParseKey("not base64!")
+	if err == nil {
+		t.Fatalf("expected error for invalid encoding")
+	}
+
+	_, err = ParseKey("c2hvcnQ=")
+	if err == nil {
+		t.Fatalf("expected error for short key")
+	}
+
+	key, err := ParseKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(key) != KeySize {
+		t.Fatalf("unexpected key length: %d", len(key))
+	}
+}
@@ -0,0 +1,15 @@
+package registry
+
+import "github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+
+// Store persists OPA registrations so that they can be restored when the
+// server restarts.
+type Store interface {
+	// Load returns all stored registrations keyed by ref.
+	Load() (map[string]config.OPA, error)
+	// Put creates or replaces the registration for ref.
+	Put(ref string, cfg config.OPA) error
+	// Delete removes the registration for ref, it is not an error if there
+	// is no such registration.
+	Delete(ref string) error
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+)
+
+// realm is sent in the challenge of unauthenticated responses.
+const realm = "demo-live-policy-update"
+
+// Authenticator checks requests against the methods configured in
+// config.Auth. A nil *Authenticator accepts all requests so that
+// authentication is optional.
+type Authenticator struct {
+	// tokens holds the hashes of the bearer tokens so that they can be
+	// compared in constant time regardless of length
+	tokens [][sha256.Size]byte
+
+	// users maps basic auth users to their bcrypt hashes
+	users map[string][]byte
+
+	trustedHeader  string
+	trustedProxies []netip.Prefix
+}
+
+// New returns an Authenticator for cfg, or nil when no authentication
+// method is configured.
+func New(cfg config.Auth) (*Authenticator, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	a := &Authenticator{
+		trustedHeader: cfg.TrustedHeader,
+	}
+
+	for _, t := range cfg.Tokens {
+		t, err = config.ResolveSecret(context.Background(), t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth token: %w", err)
+		}
+
+		a.tokens = append(a.tokens, sha256.Sum256([]byte(t)))
+	}
+
+	if cfg.HtpasswdPath != "" {
+		a.users, err = readHtpasswd(cfg.HtpasswdPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range cfg.TrustedProxies {
+		prefix, err := parsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+
+		a.trustedProxies = append(a.trustedProxies, prefix)
+	}
+
+	return a, nil
+}
+
+// readHtpasswd reads the users of an htpasswd file, only bcrypt hashes are
+// supported as the other formats are not safe to store passwords with.
+func readHtpasswd(path string) (map[string][]byte, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+
+	users := map[string][]byte{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd line %d: expected user:hash", line)
+		}
+
+		_, err = bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("htpasswd line %d: only bcrypt hashes are supported", line)
+		}
+
+		users[user] = []byte(hash)
+	}
+
+	return users, scanner.Err()
+}
+
+// parsePrefix parses a CIDR, a single address is treated as a prefix
+// matching only itself.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Authenticate returns the user authenticated by r, ok is false when r is
+// not authenticated. Bearer tokens have no user, they are reported as
+// "token".
+func (a *Authenticator) Authenticate(r *http.Request) (user string, ok bool) {
+	if a == nil {
+		return "", true
+	}
+
+	if a.trustedHeader != "" && a.fromTrustedProxy(r) {
+		if user := r.Header.Get(a.trustedHeader); user != "" {
+			return user, true
+		}
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && len(a.tokens) > 0 {
+		hash := sha256.Sum256([]byte(token))
+
+		match := 0
+		for _, t := range a.tokens {
+			match |= subtle.ConstantTimeCompare(hash[:], t[:])
+		}
+
+		if match == 1 {
+			return "token", true
+		}
+	}
+
+	if user, password, ok := r.BasicAuth(); ok && a.users != nil {
+		hash, known := a.users[user]
+		if known && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+			return user, true
+		}
+	}
+
+	return "", false
+}
+
+func (a *Authenticator) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, p := range a.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Middleware rejects requests to next which are not authenticated. Clients
+// are challenged for basic auth credentials when an htpasswd file is
+// configured so that browsers prompt for them.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := a.Authenticate(r); !ok {
+			if a.users != nil {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+			} else {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+			}
+
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("authentication required"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+)
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("alice-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("unexpected error hashing password: %s", err)
+	}
+
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	err = os.WriteFile(htpasswdPath, []byte("# admins\nalice:"+string(hash)+"\n"), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error writing htpasswd file: %s", err)
+	}
+
+	a, err := New(config.Auth{
+		Tokens:         []string{"example-token"},
+		HtpasswdPath:   htpasswdPath,
+		TrustedHeader:  "X-Forwarded-User",
+		TrustedProxies: []string{"10.0.0.0/8", "::1"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating authenticator: %s", err)
+	}
+
+	testCases := map[string]struct {
+		remoteAddr   string
+		header       http.Header
+		basicAuth    []string
+		expectedOK   bool
+		expectedUser string
+	}{
+		"no credentials": {
+			remoteAddr: "192.0.2.1:1234",
+		},
+		"bearer token": {
+			remoteAddr:   "192.0.2.1:1234",
+			header:       http.Header{"Authorization": {"Bearer example-token"}},
+			expectedOK:   true,
+			expectedUser: "token",
+		},
+		"wrong bearer token": {
+			remoteAddr: "192.0.2.1:1234",
+			header:     http.Header{"Authorization": {"Bearer other-token"}},
+		},
+		"basic auth": {
+			remoteAddr:   "192.0.2.1:1234",
+			basicAuth:    []string{"alice", "alice-password"},
+			expectedOK:   true,
+			expectedUser: "alice",
+		},
+		"wrong password": {
+			remoteAddr: "192.0.2.1:1234",
+			basicAuth:  []string{"alice", "bob-password"},
+		},
+		"unknown user": {
+			remoteAddr: "192.0.2.1:1234",
+			basicAuth:  []string{"bob", "alice-password"},
+		},
+		"trusted proxy": {
+			remoteAddr:   "10.1.2.3:1234",
+			header:       http.Header{"X-Forwarded-User": {"carol"}},
+			expectedOK:   true,
+			expectedUser: "carol",
+		},
+		"trusted proxy address": {
+			remoteAddr:   "[::1]:1234",
+			header:       http.Header{"X-Forwarded-User": {"carol"}},
+			expectedOK:   true,
+			expectedUser: "carol",
+		},
+		"untrusted proxy": {
+			remoteAddr: "192.0.2.1:1234",
+			header:     http.Header{"X-Forwarded-User": {"carol"}},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/opas", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			if tc.basicAuth != nil {
+				req.SetBasicAuth(tc.basicAuth[0], tc.basicAuth[1])
+			}
+
+			user, ok := a.Authenticate(req)
+			if ok != tc.expectedOK {
+				t.Fatalf("unexpected authentication result: %v", ok)
+			}
+
+			if user != tc.expectedUser {
+				t.Fatalf("unexpected user: %q", user)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	a, err := New(config.Auth{Tokens: []string{"example-token"}})
+	if err != nil {
+		t.Fatalf("unexpected error creating authenticator: %s", err)
+	}
+
+	rr := httptest.NewRecorder()
+	a.Middleware(next).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/opas", nil))
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code: %d", rr.Code)
+	}
+
+	if rr.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected a challenge to be present")
+	}
+
+	// no authenticator is created without an authentication method, all
+	// requests are accepted
+	a, err = New(config.Auth{})
+	if err != nil {
+		t.Fatalf("unexpected error creating authenticator: %s", err)
+	}
+
+	rr = httptest.NewRecorder()
+	a.Middleware(next).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/opas", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", rr.Code)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	err := os.WriteFile(htpasswdPath, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error writing htpasswd file: %s", err)
+	}
+
+	testCases := map[string]config.Auth{
+		"sha htpasswd":          {HtpasswdPath: htpasswdPath},
+		"missing htpasswd":      {HtpasswdPath: filepath.Join(t.TempDir(), "missing")},
+		"header without proxy":  {TrustedHeader: "X-Forwarded-User"},
+		"invalid proxy":         {TrustedHeader: "X-Forwarded-User", TrustedProxies: []string{"proxy"}},
+		"empty token":           {Tokens: []string{""}},
+		"protect demo disabled": {ProtectDemo: true},
+	}
+
+	for name, cfg := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(cfg)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
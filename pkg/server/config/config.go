@@ -2,20 +2,485 @@ package config
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	// SourceKindDAS loads the bundle for a Styra DAS system.
+	SourceKindDAS = "das"
+	// SourceKindHTTP loads a bundle from a generic HTTP bundle server, such
+	// as nginx or an S3 bucket, at an arbitrary resource path.
+	SourceKindHTTP = "http"
+	// SourceKindFile loads a bundle from a local directory or .tar.gz file,
+	// reloading it whenever it changes.
+	SourceKindFile = "file"
+	// SourceKindOCI pulls a bundle published as an OCI artifact from a
+	// container registry.
+	SourceKindOCI = "oci"
+)
+
+const (
+	// TriggerPeriodic polls for bundle updates, this is the default.
+	TriggerPeriodic = "periodic"
+	// TriggerManual only downloads bundles when a refresh is requested.
+	TriggerManual = "manual"
+)
+
 type Config struct {
-	Address string         `yaml:"address"`
-	Port    int            `yaml:"port"`
-	OPAs    map[string]OPA `yaml:"opas"`
+	Address  string         `yaml:"address"`
+	Port     int            `yaml:"port"`
+	OPAs     map[string]OPA `yaml:"opas"`
+	Registry Registry       `yaml:"registry"`
+	Auth     Auth           `yaml:"auth"`
+
+	// FileSourceRoot is the directory file sources registered at runtime
+	// must be within, file sources may only be used in the config file when
+	// it is empty.
+	FileSourceRoot string `yaml:"file_source_root"`
+}
+
+// Auth configures how requests to the admin routes are authenticated, a
+// request is accepted when it passes any of the configured methods. All
+// routes are public when no method is configured.
+type Auth struct {
+	// Tokens are accepted as bearer tokens in the Authorization header, they
+	// may be secret references which are resolved at startup.
+	Tokens []string `yaml:"tokens"`
+
+	// HtpasswdPath is a file of user:hash lines accepted as basic auth
+	// credentials, hashes must be bcrypt as created by htpasswd -B.
+	HtpasswdPath string `yaml:"htpasswd_path"`
+
+	// TrustedHeader is a header holding the user authenticated by a reverse
+	// proxy, such as X-Forwarded-User. It is only read from requests made by
+	// TrustedProxies.
+	TrustedHeader  string   `yaml:"trusted_header"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// ProtectDemo requires the demo pages to be authenticated too, they are
+	// public by default.
+	ProtectDemo bool `yaml:"protect_demo"`
+}
+
+// Enabled returns true when requests must be authenticated.
+func (a Auth) Enabled() bool {
+	return len(a.Tokens) > 0 || a.HtpasswdPath != "" || a.TrustedHeader != ""
+}
+
+// Validate returns an error if the settings cannot be used.
+func (a Auth) Validate() error {
+	for _, t := range a.Tokens {
+		if t == "" {
+			return fmt.Errorf("auth tokens must not be empty")
+		}
+	}
+
+	if a.TrustedHeader != "" && len(a.TrustedProxies) == 0 {
+		return fmt.Errorf("trusted_proxies must be provided to use a trusted_header")
+	}
+
+	if a.TrustedHeader == "" && len(a.TrustedProxies) > 0 {
+		return fmt.Errorf("trusted_header must be provided to use trusted_proxies")
+	}
+
+	if a.ProtectDemo && !a.Enabled() {
+		return fmt.Errorf("protect_demo requires an authentication method to be configured")
+	}
+
+	return nil
 }
 
+// Registry configures where OPAs registered at runtime are persisted.
+type Registry struct {
+	// Path is the JSON file registrations are stored in, registrations are
+	// only held in memory when it is empty.
+	Path string `yaml:"path"`
+
+	// KeyEnv is the name of the environment variable holding the base64
+	// encoded 32 byte key used to encrypt registrations. Defaults to
+	// DefaultRegistryKeyEnv.
+	KeyEnv string `yaml:"key_env"`
+}
+
+// DefaultRegistryKeyEnv is the environment variable read for the registry
+// encryption key when Registry.KeyEnv is not set.
+const DefaultRegistryKeyEnv = "REGISTRY_KEY"
+
 type OPA struct {
-	Endpoint string `yaml:"endpoint"`
-	Token    string `yaml:"token"`
-	SystemID string `yaml:"system_id"`
+	Source `yaml:",inline"`
+
+	// Bundles are loaded alongside the bundle of Source, such as a shared
+	// library or data bundle. Each bundle has its own service and polling
+	// settings.
+	Bundles []Bundle `yaml:"bundles" json:"bundles,omitempty"`
+
+	// Demo configures the form and decision of the demo page.
+	Demo Demo `yaml:"demo" json:"demo"`
+
+	// DecisionLogs configures how the decisions made by the OPA are kept.
+	DecisionLogs DecisionLogs `yaml:"decision_logs" json:"decision_logs"`
+
+	// Cache configures caching of the decisions made by the OPA.
+	Cache Cache `yaml:"cache" json:"cache"`
+}
+
+// Sources returns the bundles loaded by the OPA, starting with the bundle of
+// the inline Source.
+func (o OPA) Sources() []Bundle {
+	return append([]Bundle{{Source: o.Source}}, o.Bundles...)
+}
+
+// WithSecretsFrom returns the registration with the secrets left blank
+// taken from current as described by Source.WithSecretsFrom. Additional
+// bundles are matched with the bundle of current at the same position and
+// with the same name.
+func (o OPA) WithSecretsFrom(current OPA) OPA {
+	o.Source = o.Source.WithSecretsFrom(current.Source)
+
+	o.Bundles = append([]Bundle(nil), o.Bundles...)
+	for i := range o.Bundles {
+		if i < len(current.Bundles) && o.Bundles[i].Name == current.Bundles[i].Name {
+			o.Bundles[i].Source = o.Bundles[i].Source.WithSecretsFrom(current.Bundles[i].Source)
+		}
+	}
+
+	return o
+}
+
+// Redacted returns the registration with the secrets of all of its sources
+// removed.
+func (o OPA) Redacted() OPA {
+	o.Source = o.Source.Redacted()
+
+	o.Bundles = append([]Bundle(nil), o.Bundles...)
+	for i := range o.Bundles {
+		o.Bundles[i].Source = o.Bundles[i].Source.Redacted()
+	}
+
+	return o
+}
+
+// Bundle is a bundle loaded by an OPA.
+type Bundle struct {
+	// Name is the name the bundle is reported under, it defaults to a name
+	// derived from the source such as systems/<system_id> for DAS sources.
+	Name string `yaml:"name" json:"name,omitempty"`
+
+	Source `yaml:",inline"`
+}
+
+// Source describes where an OPA instance loads its bundle from.
+type Source struct {
+	// Kind is one of the SourceKind constants, an empty Kind is treated as
+	// SourceKindDAS.
+	Kind     string `yaml:"kind" json:"kind,omitempty"`
+	Endpoint string `yaml:"endpoint" json:"endpoint,omitempty"`
+
+	// Token, Password and Verification.Secret may be secret references such
+	// as ${NAME} or file:/path when set in the config file, see
+	// ResolveSecret.
+	Token string `yaml:"token" json:"token,omitempty"`
+
+	// SystemID is used by SourceKindDAS sources only.
+	SystemID string `yaml:"system_id" json:"system_id,omitempty"`
+
+	// Resource is the path of the bundle relative to the endpoint and is used
+	// by SourceKindHTTP sources only.
+	Resource string `yaml:"resource" json:"resource,omitempty"`
+
+	// Path is the bundle directory or .tar.gz file and is used by
+	// SourceKindFile sources only.
+	Path string `yaml:"path" json:"path,omitempty"`
+
+	// Reference is the OCI reference of the bundle, such as
+	// ghcr.io/example/policy:latest, and is used by SourceKindOCI sources
+	// only. The registry in the reference is used when Endpoint is not set.
+	Reference string `yaml:"reference" json:"reference,omitempty"`
+
+	// Username and Password are used for basic authentication against the
+	// registry of SourceKindOCI sources, Token is sent as a bearer token
+	// when they are not set.
+	Username string `yaml:"username" json:"username,omitempty"`
+	Password string `yaml:"password" json:"password,omitempty"`
+
+	// Trigger is one of the Trigger constants, an empty Trigger is treated
+	// as TriggerPeriodic.
+	Trigger string `yaml:"trigger" json:"trigger,omitempty"`
+
+	// Polling configures how often a TriggerPeriodic source checks for
+	// bundle updates.
+	Polling Polling `yaml:"polling" json:"polling"`
+
+	// Verification configures the key bundles must be signed with, bundles
+	// are accepted without verification when it is empty.
+	Verification Verification `yaml:"verification" json:"verification"`
+}
+
+// Polling configures bundle polling, delays default to one second when
+// unset.
+type Polling struct {
+	MinDelaySeconds int64 `yaml:"min_delay_seconds" json:"min_delay_seconds,omitempty"`
+	MaxDelaySeconds int64 `yaml:"max_delay_seconds" json:"max_delay_seconds,omitempty"`
+
+	// LongPollingTimeoutSeconds enables long polling when set, the bundle
+	// server must support it.
+	LongPollingTimeoutSeconds int64 `yaml:"long_polling_timeout_seconds" json:"long_polling_timeout_seconds,omitempty"`
+}
+
+// Verification configures bundle signature verification. Either PublicKey or
+// Secret must be set along with KeyID.
+type Verification struct {
+	// KeyID identifies the key, it must match the kid of the bundle
+	// signature unless the signature does not set one.
+	KeyID string `yaml:"key_id" json:"key_id,omitempty"`
+
+	// PublicKey is the PEM encoded key used to verify bundles signed with
+	// an asymmetric algorithm.
+	PublicKey string `yaml:"public_key" json:"public_key,omitempty"`
+
+	// Secret is the shared secret used to verify bundles signed with an
+	// HMAC algorithm.
+	Secret string `yaml:"secret" json:"secret,omitempty"`
+
+	// Algorithm is the signing algorithm, it defaults to RS256 for public
+	// keys and HS256 for secrets.
+	Algorithm string `yaml:"algorithm" json:"algorithm,omitempty"`
+
+	// Scope must match the scope of the bundle signature when set.
+	Scope string `yaml:"scope" json:"scope,omitempty"`
+}
+
+// Enabled returns true when bundles must be verified.
+func (v Verification) Enabled() bool {
+	return v != Verification{}
+}
+
+// WithSecretsFrom returns the source with the secrets left blank taken from
+// current, so that registrations can be edited without echoing secrets back
+// to clients. Secrets are only kept while the kind and endpoint are
+// unchanged so that they are never sent to a different server, and the
+// verification secret is only kept for the same key.
+func (s Source) WithSecretsFrom(current Source) Source {
+	kind, currentKind := s.Kind, current.Kind
+	if kind == "" {
+		kind = SourceKindDAS
+	}
+	if currentKind == "" {
+		currentKind = SourceKindDAS
+	}
+
+	if kind == currentKind && s.Endpoint == current.Endpoint {
+		if s.Token == "" {
+			s.Token = current.Token
+		}
+
+		if s.Password == "" && s.Username == current.Username {
+			s.Password = current.Password
+		}
+	}
+
+	v := &s.Verification
+	if v.Secret == "" && v.PublicKey == "" && v.KeyID != "" && v.KeyID == current.Verification.KeyID {
+		v.Secret = current.Verification.Secret
+	}
+
+	return s
+}
+
+// Redacted returns the source with its secrets removed.
+func (s Source) Redacted() Source {
+	s.Token = ""
+	s.Password = ""
+	s.Verification.Secret = ""
+
+	return s
+}
+
+// DefaultDecisionLogSize is the number of decisions kept in memory when
+// DecisionLogs.Size is not set.
+const DefaultDecisionLogSize = 100
+
+// MaxDecisionLogSize is the largest number of decisions an OPA may keep in
+// memory.
+const MaxDecisionLogSize = 10000
+
+// DecisionLogs configures the decision log of an OPA. The most recent
+// decisions are always kept in memory.
+type DecisionLogs struct {
+	// Size is the number of decisions kept in memory, it defaults to
+	// DefaultDecisionLogSize.
+	Size int `yaml:"size" json:"size,omitempty"`
+
+	// Path is a file each decision is also appended to as a line of JSON,
+	// decisions are only kept in memory when it is empty.
+	Path string `yaml:"path" json:"path,omitempty"`
+}
+
+// WithDefaults returns the settings with defaults applied for unset values.
+func (d DecisionLogs) WithDefaults() DecisionLogs {
+	if d.Size == 0 {
+		d.Size = DefaultDecisionLogSize
+	}
+
+	return d
+}
+
+// Validate returns an error if the settings cannot be used.
+func (d DecisionLogs) Validate() error {
+	if d.Size < 0 {
+		return fmt.Errorf("decision log size must not be negative")
+	}
+
+	if d.Size > MaxDecisionLogSize {
+		return fmt.Errorf("decision log size must not be greater than %d", MaxDecisionLogSize)
+	}
+
+	return nil
+}
+
+// Cache configures the decision cache of an OPA. Cached decisions are keyed
+// on the path and input, so policies using the time or making HTTP requests
+// should not be cached. Decisions served from the cache are logged as cached.
+type Cache struct {
+	// Size is the number of decisions cached, the least recently used are
+	// evicted once it is reached. Decisions are not cached when it is zero.
+	Size int `yaml:"size" json:"size,omitempty"`
+}
+
+// Enabled returns true when decisions are cached.
+func (c Cache) Enabled() bool {
+	return c.Size > 0
+}
+
+// Validate returns an error if the settings cannot be used.
+func (c Cache) Validate() error {
+	if c.Size < 0 {
+		return fmt.Errorf("cache size must not be negative")
+	}
+
+	return nil
+}
+
+const (
+	// DemoFieldString is submitted as a string, this is the default.
+	DemoFieldString = "string"
+	// DemoFieldNumber is submitted as a number.
+	DemoFieldNumber = "number"
+	// DemoFieldBoolean is submitted as true or false.
+	DemoFieldBoolean = "boolean"
+)
+
+// jsonNumberPattern matches the number grammar of JSON, which unlike
+// strconv.ParseFloat does not accept NaN, infinities or hexadecimal.
+var jsonNumberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// IsJSONNumber returns true when s can be submitted as a JSON number.
+func IsJSONNumber(s string) bool {
+	return jsonNumberPattern.MatchString(s)
+}
+
+// DefaultDemoPath is the decision shown on the demo page when Demo.Path is
+// not set.
+const DefaultDemoPath = "/policy/allow"
+
+// Demo configures the demo page of an OPA.
+type Demo struct {
+	// Label is the heading of the demo page, the ref of the OPA is used when
+	// it is empty.
+	Label string `yaml:"label" json:"label,omitempty"`
+
+	// Path is the decision evaluated, it defaults to DefaultDemoPath.
+	Path string `yaml:"path" json:"path,omitempty"`
+
+	// Fields are the inputs of the demo form. A single name field with the
+	// default alice is used when there are none.
+	Fields []DemoField `yaml:"fields" json:"fields,omitempty"`
+}
+
+// DemoField is an input of the demo form.
+type DemoField struct {
+	// Name is the key of the field in the input document, dots nest the
+	// field in objects, such as user.role for {"user": {"role": ...}}.
+	Name string `yaml:"name" json:"name"`
+
+	// Type is one of the DemoField constants, an empty Type is treated as
+	// DemoFieldString.
+	Type string `yaml:"type" json:"type,omitempty"`
+
+	// Default is the value of the field until another is submitted.
+	Default string `yaml:"default" json:"default,omitempty"`
+}
+
+// WithDefaults returns the settings with defaults applied for unset values.
+func (d Demo) WithDefaults() Demo {
+	if d.Path == "" {
+		d.Path = DefaultDemoPath
+	}
+
+	if len(d.Fields) == 0 {
+		d.Fields = []DemoField{{Name: "name", Default: "alice"}}
+	}
+
+	fields := make([]DemoField, len(d.Fields))
+	for i, f := range d.Fields {
+		if f.Type == "" {
+			f.Type = DemoFieldString
+		}
+		fields[i] = f
+	}
+	d.Fields = fields
+
+	return d
+}
+
+// Validate returns an error if the settings cannot be used to build the
+// demo form.
+func (d Demo) Validate() error {
+	if d.Path != "" && !strings.HasPrefix(d.Path, "/") {
+		return fmt.Errorf("demo path must start with /")
+	}
+
+	names := map[string]bool{}
+	for _, f := range d.WithDefaults().Fields {
+		if f.Name == "" || strings.HasPrefix(f.Name, ".") || strings.HasSuffix(f.Name, ".") || strings.Contains(f.Name, "..") {
+			return fmt.Errorf("demo field name %q is not valid", f.Name)
+		}
+
+		if names[f.Name] {
+			return fmt.Errorf("demo field %q is used more than once", f.Name)
+		}
+		names[f.Name] = true
+
+		// a field cannot be both a value and an object of other fields
+		for name := range names {
+			if strings.HasPrefix(name, f.Name+".") || strings.HasPrefix(f.Name, name+".") {
+				return fmt.Errorf("demo fields %q and %q overlap", name, f.Name)
+			}
+		}
+
+		valid := true
+		switch f.Type {
+		case DemoFieldString:
+		case DemoFieldNumber:
+			valid = f.Default == "" || IsJSONNumber(f.Default)
+		case DemoFieldBoolean:
+			if f.Default != "" {
+				_, err := strconv.ParseBool(f.Default)
+				valid = err == nil
+			}
+		default:
+			return fmt.Errorf("demo field %q has unknown type %q", f.Name, f.Type)
+		}
+		if !valid {
+			return fmt.Errorf("demo field %q has a default that is not a %s", f.Name, f.Type)
+		}
+	}
+
+	return nil
 }
 
 func ParseConfig(rawConfig []byte) (*Config, error) {
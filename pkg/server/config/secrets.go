@@ -0,0 +1,159 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Secrets such as tokens may be given as references which are resolved when
+// an OPA is started rather than in plain text:
+//
+//	${NAME}          the value of the environment variable NAME
+//	file:/path       the contents of the file, which is re-read on changes
+//	exec:cmd args    the output of the command, run without a shell
+//
+// Leading and trailing whitespace is removed from resolved values.
+const (
+	secretFilePrefix = "file:"
+	secretExecPrefix = "exec:"
+)
+
+// SecretExecTimeout is how long a secret helper may run for.
+const SecretExecTimeout = 10 * time.Second
+
+var secretEnvPattern = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// IsSecretReference returns true when value is a reference rather than a
+// plain text secret.
+func IsSecretReference(value string) bool {
+	return secretEnvPattern.MatchString(value) ||
+		strings.HasPrefix(value, secretFilePrefix) ||
+		strings.HasPrefix(value, secretExecPrefix)
+}
+
+// ResolveSecret returns the secret referenced by value, plain text values
+// are returned unchanged.
+func ResolveSecret(ctx context.Context, value string) (string, error) {
+	if m := secretEnvPattern.FindStringSubmatch(value); m != nil {
+		secret, ok := os.LookupEnv(m[1])
+		if !ok || strings.TrimSpace(secret) == "" {
+			return "", fmt.Errorf("environment variable %s is not set", m[1])
+		}
+
+		return strings.TrimSpace(secret), nil
+	}
+
+	if path, ok := strings.CutPrefix(value, secretFilePrefix); ok {
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+
+		secret := strings.TrimSpace(string(bs))
+		if secret == "" {
+			return "", fmt.Errorf("secret file %s is empty", path)
+		}
+
+		return secret, nil
+	}
+
+	if command, ok := strings.CutPrefix(value, secretExecPrefix); ok {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return "", fmt.Errorf("secret helper command must be provided")
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, SecretExecTimeout)
+		defer cancel()
+
+		var stdout, stderr bytes.Buffer
+
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		err := cmd.Run()
+		if err != nil {
+			return "", fmt.Errorf("secret helper %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+
+		secret := strings.TrimSpace(stdout.String())
+		if secret == "" {
+			return "", fmt.Errorf("secret helper %s returned an empty secret", args[0])
+		}
+
+		return secret, nil
+	}
+
+	return value, nil
+}
+
+// secrets returns pointers to the secrets of the source.
+func (s *Source) secrets() []*string {
+	return []*string{&s.Token, &s.Password, &s.Verification.Secret}
+}
+
+// sources returns pointers to the sources of the registration.
+func (o *OPA) sources() []*Source {
+	sources := []*Source{&o.Source}
+	for i := range o.Bundles {
+		sources = append(sources, &o.Bundles[i].Source)
+	}
+
+	return sources
+}
+
+// ResolveSecrets returns the registration with all secret references
+// resolved.
+func (o OPA) ResolveSecrets(ctx context.Context) (OPA, error) {
+	o.Bundles = append([]Bundle(nil), o.Bundles...)
+
+	for _, s := range o.sources() {
+		for _, secret := range s.secrets() {
+			resolved, err := ResolveSecret(ctx, *secret)
+			if err != nil {
+				return o, err
+			}
+
+			*secret = resolved
+		}
+	}
+
+	return o, nil
+}
+
+// SecretReferences returns the secret references used by the registration.
+// References may only be used in the config file, registrations made at
+// runtime must not use them as they could read the files and environment of
+// the server or run commands on it.
+func (o OPA) SecretReferences() []string {
+	var refs []string
+	for _, s := range o.sources() {
+		for _, secret := range s.secrets() {
+			if IsSecretReference(*secret) {
+				refs = append(refs, *secret)
+			}
+		}
+	}
+
+	return refs
+}
+
+// SecretFiles returns the files secrets are read from, the secrets must be
+// resolved again when they change.
+func (o OPA) SecretFiles() []string {
+	var paths []string
+	for _, ref := range o.SecretReferences() {
+		if path, ok := strings.CutPrefix(ref, secretFilePrefix); ok {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
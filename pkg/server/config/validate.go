@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// MaxRefLength is the longest ref an OPA can be registered under at
+// runtime.
+const MaxRefLength = 63
+
+var (
+	refPattern      = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	systemIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// ValidateRef returns an error if ref cannot be used to register an OPA at
+// runtime. Refs are used in URL paths, so they are restricted to slugs of
+// lowercase letters, digits and hyphens.
+func ValidateRef(ref string) error {
+	if ref == "" {
+		return fmt.Errorf("ref must be provided")
+	}
+
+	if len(ref) > MaxRefLength {
+		return fmt.Errorf("ref must be at most %d characters", MaxRefLength)
+	}
+
+	if !refPattern.MatchString(ref) {
+		return fmt.Errorf("ref must only contain lowercase letters, digits and hyphens, and must start and end with a letter or digit")
+	}
+
+	return nil
+}
+
+// ValidateSystemID returns an error if id is not a valid DAS system ID, ids
+// are used in the bundle path so may only contain letters, digits, hyphens
+// and underscores.
+func ValidateSystemID(id string) error {
+	if id == "" {
+		return fmt.Errorf("system_id must be provided")
+	}
+
+	if !systemIDPattern.MatchString(id) {
+		return fmt.Errorf("system_id must only contain letters, digits, hyphens and underscores")
+	}
+
+	return nil
+}
+
+// ValidateEndpoint returns an error if endpoint is not an http or https URL.
+// Endpoints without a scheme are treated as http as they are by the OPA
+// config.
+func ValidateEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return fmt.Errorf("endpoint must be provided")
+	}
+
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("endpoint must be a valid URL")
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("endpoint must use the http or https scheme")
+	}
+
+	if u.Host == "" || u.Hostname() == "" {
+		return fmt.Errorf("endpoint must include a host")
+	}
+
+	if u.User != nil {
+		return fmt.Errorf("endpoint must not include credentials, use the token instead")
+	}
+
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("endpoint must not include a query or fragment")
+	}
+
+	return nil
+}
+
+// ValidateFileSourcePath returns an error if path may not be used by a file
+// source registered at runtime. Such sources could otherwise load any
+// directory the server can read, so they must be within root and are not
+// allowed when root is empty. Symlinks are resolved before the check.
+func ValidateFileSourcePath(root, path string) error {
+	if root == "" {
+		return fmt.Errorf("file sources may only be used in the config file")
+	}
+
+	if path == "" {
+		return fmt.Errorf("path must be provided")
+	}
+
+	resolvedRoot, err := resolvePath(root)
+	if err != nil {
+		return fmt.Errorf("file source root is not valid: %w", err)
+	}
+
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return fmt.Errorf("path is not valid: %w", err)
+	}
+
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("path must be within %s", root)
+	}
+
+	return nil
+}
+
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.EvalSymlinks(abs)
+}
+
+// ValidateRuntime returns an error if the registration uses settings which
+// may only be used in the config file, as they give access to the files of
+// the server. Settings which are the same as those of current are allowed,
+// so that OPAs from the config file can be updated at runtime, current is
+// the zero OPA for new registrations.
+func (o OPA) ValidateRuntime(current OPA, fileSourceRoot string) error {
+	if o.DecisionLogs.Path != "" && o.DecisionLogs.Path != current.DecisionLogs.Path {
+		return fmt.Errorf("decision_logs.path may only be set in the config file")
+	}
+
+	currentSources := current.Sources()
+
+	for i, b := range o.Sources() {
+		if b.Kind != SourceKindFile {
+			continue
+		}
+
+		if i < len(currentSources) && currentSources[i].Kind == SourceKindFile && currentSources[i].Path == b.Path {
+			continue
+		}
+
+		err := ValidateFileSourcePath(fileSourceRoot, b.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
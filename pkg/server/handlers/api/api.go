@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+)
+
+// errorResponse is the body of all error responses. Code identifies the kind
+// of error so that clients do not need to match on the message.
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// errorCodes are the codes of the errors returned by the opa.Manager, other
+// errors use a code derived from the status of the response.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{opa.ErrNotFound, "not_found"},
+	{opa.ErrAlreadyExists, "already_exists"},
+	{opa.ErrNotReady, "not_ready"},
+	{opa.ErrInvalidConfig, "invalid_config"},
+	{opa.ErrRevisionChanged, "revision_changed"},
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error(), Code: errorCode(status, err)})
+}
+
+func errorCode(status int, err error) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/open-policy-agent/opa/sdk"
+	"github.com/open-policy-agent/opa/server/types"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+// maxBatchItems limits the number of decisions in a single batch request.
+const maxBatchItems = 1000
+
+type batchRequest struct {
+	Items []batchItem `json:"items"`
+}
+
+type batchItem struct {
+	Path  string       `json:"path"`
+	Input *interface{} `json:"input"`
+}
+
+type batchResponse struct {
+	// Provenance is shared by all results as they are evaluated against the
+	// same bundle revisions.
+	Provenance *types.ProvenanceV1 `json:"provenance,omitempty"`
+
+	Results []batchItemResponse `json:"results"`
+}
+
+type batchItemResponse struct {
+	DecisionID string       `json:"decision_id,omitempty"`
+	Result     *interface{} `json:"result,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// NewBatchDecisionHandler serves POST /api/v1/opas/{ref}/batch, evaluating
+// each item of the request body and returning the results in the same order.
+func NewBatchDecisionHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.PathValue("ref")
+
+		var req batchRequest
+
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+
+		err := decoder.Decode(&req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+
+		if len(req.Items) == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("items must be provided"))
+			return
+		}
+
+		if len(req.Items) > maxBatchItems {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("at most %d items may be provided", maxBatchItems))
+			return
+		}
+
+		decisions := make([]sdk.DecisionOptions, len(req.Items))
+		for i, item := range req.Items {
+			if item.Path == "" {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("items[%d]: path must be provided", i))
+				return
+			}
+
+			decisions[i].Path = item.Path
+			if item.Input != nil {
+				decisions[i].Input = *item.Input
+			}
+		}
+
+		results, err := opts.OPAManager.BatchDecision(r.Context(), ref, decisions)
+		switch {
+		case errors.Is(err, opa.ErrNotFound):
+			writeError(w, http.StatusNotFound, err)
+			return
+		case errors.Is(err, opa.ErrNotReady), errors.Is(err, opa.ErrRevisionChanged):
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		resp := batchResponse{
+			Results: make([]batchItemResponse, len(results)),
+		}
+
+		for i, result := range results {
+			if result.Result != nil {
+				resp.Results[i].DecisionID = result.Result.ID
+
+				if resp.Provenance == nil {
+					resp.Provenance = &result.Result.Provenance
+				}
+			}
+
+			switch {
+			case result.Err == nil:
+				resp.Results[i].Result = &result.Result.Result
+			case !sdk.IsUndefinedErr(result.Err):
+				resp.Results[i].Error = result.Err.Error()
+			}
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}, nil
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+func TestBatchDecision(t *testing.T) {
+	var err error
+
+	modulePath := "policy/allow.rego"
+	exampleMod := `package policy
+import rego.v1
+default allow := false
+allow if input.name in {"alice", "bob"}
+conflict := 1 if input.name == "error"
+conflict := 2 if input.name == "error"
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "rev-1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err = bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	ctx := context.Background()
+
+	m := opa.NewManager()
+	err = m.Add(
+		ctx,
+		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.URL,
+			},
+		},
+		opa.WaitForActivation(5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example1")
+
+	h, err := NewBatchDecisionHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating batch handler: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/v1/opas/{ref}/batch", h)
+
+	names := []string{"alice", "mallory", "bob"}
+
+	items := []string{}
+	for i := 0; i < 50; i++ {
+		items = append(items, fmt.Sprintf(`{"path": "/policy/allow", "input": {"name": %q}}`, names[i%len(names)]))
+	}
+	items = append(items,
+		`{"path": "/policy/missing", "input": {}}`,
+		`{"path": "/policy/conflict", "input": {"name": "error"}}`,
+	)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(
+		http.MethodPost,
+		"/api/v1/opas/example1/batch",
+		strings.NewReader(`{"items": [`+strings.Join(items, ",")+`]}`),
+	)
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp struct {
+		Provenance struct {
+			Bundles map[string]struct {
+				Revision string `json:"revision"`
+			} `json:"bundles"`
+		} `json:"provenance"`
+		Results []struct {
+			DecisionID string       `json:"decision_id"`
+			Result     *interface{} `json:"result"`
+			Error      string       `json:"error"`
+		} `json:"results"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("unexpected error decoding response: %s", err)
+	}
+
+	if resp.Provenance.Bundles["systems/example1"].Revision != "rev-1" {
+		t.Fatalf("unexpected provenance: %+v", resp.Provenance)
+	}
+
+	if len(resp.Results) != len(items) {
+		t.Fatalf("unexpected number of results: %d", len(resp.Results))
+	}
+
+	for i := 0; i < 50; i++ {
+		result := resp.Results[i]
+
+		if result.Error != "" || result.Result == nil {
+			t.Fatalf("unexpected result %d: %+v", i, result)
+		}
+
+		expected := names[i%len(names)] != "mallory"
+		if *result.Result != expected {
+			t.Fatalf("unexpected result %d for %s: %v", i, names[i%len(names)], *result.Result)
+		}
+	}
+
+	undefined := resp.Results[50]
+	if undefined.Result != nil || undefined.Error != "" {
+		t.Fatalf("expected undefined result, got %+v", undefined)
+	}
+
+	conflict := resp.Results[51]
+	if conflict.Result != nil || conflict.Error == "" {
+		t.Fatalf("expected error result, got %+v", conflict)
+	}
+}
+
+func TestBatchDecisionInvalidRequest(t *testing.T) {
+	h, err := NewBatchDecisionHandler(&handlers.Options{
+		OPAManager: opa.NewManager(),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating batch handler: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/v1/opas/{ref}/batch", h)
+
+	testCases := map[string]struct {
+		body           string
+		expectedStatus int
+	}{
+		"invalid json": {
+			body:           `{"items": [`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		"no items": {
+			body:           `{"items": []}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		"missing path": {
+			body:           `{"items": [{"input": {}}]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		"unknown opa": {
+			body:           `{"items": [{"path": "/policy/allow"}]}`,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/opas/missing/batch", strings.NewReader(tc.body))
+			mux.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("unexpected status code: %d, body: %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
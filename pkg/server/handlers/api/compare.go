@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/open-policy-agent/opa/sdk"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+type compareRequest struct {
+	Refs  []string     `json:"refs"`
+	Path  string       `json:"path"`
+	Input *interface{} `json:"input"`
+}
+
+type compareResponse struct {
+	// Consistent is true when no result differs from the others.
+	Consistent bool `json:"consistent"`
+
+	Results []compareItemResponse `json:"results"`
+}
+
+type compareItemResponse struct {
+	Ref        string            `json:"ref"`
+	DecisionID string            `json:"decision_id,omitempty"`
+	Result     *interface{}      `json:"result,omitempty"`
+	Revisions  map[string]string `json:"revisions,omitempty"`
+	Differs    bool              `json:"differs"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// NewCompareHandler serves POST /api/v1/compare, evaluating one decision on
+// several OPAs so that their results can be compared.
+func NewCompareHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req compareRequest
+
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+
+		err := decoder.Decode(&req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+
+		if len(req.Refs) == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("refs must be provided"))
+			return
+		}
+
+		if req.Path == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("path must be provided"))
+			return
+		}
+
+		options := sdk.DecisionOptions{
+			Path: req.Path,
+		}
+		if req.Input != nil {
+			options.Input = *req.Input
+		}
+
+		comparisons := opts.OPAManager.Compare(r.Context(), req.Refs, options)
+
+		resp := compareResponse{
+			Consistent: true,
+			Results:    make([]compareItemResponse, len(comparisons)),
+		}
+
+		for i, c := range comparisons {
+			item := compareItemResponse{
+				Ref:       c.Ref,
+				Revisions: c.Revisions,
+				Differs:   c.Differs,
+			}
+
+			if c.Result != nil {
+				item.DecisionID = c.Result.ID
+			}
+
+			switch {
+			case c.Err == nil:
+				item.Result = &c.Result.Result
+			case !c.Undefined():
+				item.Error = c.Err.Error()
+			}
+
+			if c.Differs {
+				resp.Consistent = false
+			}
+
+			resp.Results[i] = item
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}, nil
+}
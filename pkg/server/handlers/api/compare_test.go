@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+func TestCompare(t *testing.T) {
+	modulePath := "policy/allow.rego"
+	exampleMod := `package policy
+import rego.v1
+default allow := false
+allow if input.name == "alice"
+`
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(bundle.Bundle{
+			Manifest: bundle.Manifest{
+				Revision: "rev-1",
+			},
+			Modules: []bundle.ModuleFile{
+				{
+					URL:    modulePath,
+					Path:   modulePath,
+					Parsed: ast.MustParseModule(exampleMod),
+					Raw:    []byte(exampleMod),
+				},
+			},
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	ctx := context.Background()
+
+	m := opa.NewManager()
+	err := m.Add(
+		ctx,
+		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.URL,
+			},
+		},
+		opa.WaitForActivation(5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example1")
+
+	h, err := NewCompareHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating compare handler: %s", err)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(
+		http.MethodPost,
+		"/api/v1/compare",
+		strings.NewReader(`{"refs": ["example1", "missing"], "path": "/policy/allow", "input": {"name": "alice"}}`),
+	)
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp struct {
+		Consistent bool `json:"consistent"`
+		Results    []struct {
+			Ref       string            `json:"ref"`
+			Result    *interface{}      `json:"result"`
+			Revisions map[string]string `json:"revisions"`
+			Error     string            `json:"error"`
+		} `json:"results"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("unexpected error decoding response: %s", err)
+	}
+
+	if !resp.Consistent {
+		t.Fatalf("expected results to be consistent")
+	}
+
+	if len(resp.Results) != 2 {
+		t.Fatalf("unexpected number of results: %d", len(resp.Results))
+	}
+
+	example := resp.Results[0]
+	if example.Ref != "example1" || example.Result == nil || *example.Result != true {
+		t.Fatalf("unexpected example1 result: %+v", example)
+	}
+
+	if example.Revisions["systems/example1"] != "rev-1" {
+		t.Fatalf("unexpected example1 revisions: %v", example.Revisions)
+	}
+
+	missing := resp.Results[1]
+	if missing.Ref != "missing" || missing.Error == "" {
+		t.Fatalf("unexpected missing result: %+v", missing)
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/compare", strings.NewReader(`{"path": "/policy/allow"}`))
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code without refs: %d", rr.Code)
+	}
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/open-policy-agent/opa/sdk"
+	"github.com/open-policy-agent/opa/server/types"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+// decisionRequest matches the request body of the OPA data API.
+type decisionRequest struct {
+	Input *interface{} `json:"input"`
+}
+
+type decisionResponse struct {
+	DecisionID string `json:"decision_id"`
+
+	// Result is omitted when the decision is undefined.
+	Result *interface{} `json:"result,omitempty"`
+
+	Provenance types.ProvenanceV1 `json:"provenance"`
+}
+
+// NewDecisionHandler serves POST /api/v1/opas/{ref}/decision/{path...},
+// evaluating the decision at path with the input in the request body.
+func NewDecisionHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.PathValue("ref")
+
+		var req decisionRequest
+
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+
+		err := decoder.Decode(&req)
+		if err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+
+		options := sdk.DecisionOptions{
+			Path: "/" + r.PathValue("path"),
+		}
+		if req.Input != nil {
+			options.Input = *req.Input
+		}
+
+		dr, err := opts.OPAManager.Decision(r.Context(), ref, options)
+		switch {
+		case errors.Is(err, opa.ErrNotFound):
+			writeError(w, http.StatusNotFound, err)
+			return
+		case errors.Is(err, opa.ErrNotReady):
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		case err != nil && !sdk.IsUndefinedErr(err):
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		resp := decisionResponse{
+			DecisionID: dr.ID,
+			Provenance: dr.Provenance,
+		}
+		if err == nil {
+			resp.Result = &dr.Result
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}, nil
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+func TestDecision(t *testing.T) {
+	var err error
+
+	modulePath := "policy/allow.rego"
+	exampleMod := `package policy
+import rego.v1
+default allow := false
+allow if input.user.name in {"alice", "bob"}
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "rev-1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err = bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	ctx := context.Background()
+
+	m := opa.NewManager()
+	err = m.Add(
+		ctx,
+		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.URL,
+			},
+		},
+		opa.WaitForActivation(5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example1")
+
+	h, err := NewDecisionHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating decision handler: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/v1/opas/{ref}/decision/{path...}", h)
+
+	testCases := map[string]struct {
+		path           string
+		body           string
+		expectedStatus int
+		expectedResult interface{}
+	}{
+		"allowed": {
+			path:           "/api/v1/opas/example1/decision/policy/allow",
+			body:           `{"input": {"user": {"name": "alice"}}}`,
+			expectedStatus: http.StatusOK,
+			expectedResult: true,
+		},
+		"denied": {
+			path:           "/api/v1/opas/example1/decision/policy/allow",
+			body:           `{"input": {"user": {"name": "mallory"}}}`,
+			expectedStatus: http.StatusOK,
+			expectedResult: false,
+		},
+		"undefined": {
+			path:           "/api/v1/opas/example1/decision/policy/missing",
+			body:           `{"input": {}}`,
+			expectedStatus: http.StatusOK,
+		},
+		"no body": {
+			path:           "/api/v1/opas/example1/decision/policy/allow",
+			expectedStatus: http.StatusOK,
+			expectedResult: false,
+		},
+		"invalid body": {
+			path:           "/api/v1/opas/example1/decision/policy/allow",
+			body:           `{"input": `,
+			expectedStatus: http.StatusBadRequest,
+		},
+		"unknown opa": {
+			path:           "/api/v1/opas/missing/decision/policy/allow",
+			body:           `{"input": {}}`,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			mux.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("unexpected status code: %d, body: %s", rr.Code, rr.Body.String())
+			}
+
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				DecisionID string       `json:"decision_id"`
+				Result     *interface{} `json:"result"`
+				Provenance struct {
+					Bundles map[string]struct {
+						Revision string `json:"revision"`
+					} `json:"bundles"`
+				} `json:"provenance"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatalf("unexpected error decoding response: %s", err)
+			}
+
+			if resp.DecisionID == "" {
+				t.Fatalf("expected a decision ID")
+			}
+
+			if resp.Provenance.Bundles["systems/example1"].Revision != "rev-1" {
+				t.Fatalf("unexpected provenance: %+v", resp.Provenance)
+			}
+
+			if tc.expectedResult == nil {
+				if resp.Result != nil {
+					t.Fatalf("expected undefined result, got %v", *resp.Result)
+				}
+				return
+			}
+
+			if resp.Result == nil || *resp.Result != tc.expectedResult {
+				t.Fatalf("unexpected result: %s", rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+const (
+	// addWaitTimeout is how long creating an OPA waits for its bundle to be
+	// activated before responding, the OPA is created either way.
+	addWaitTimeout = 5 * time.Second
+
+	// updateTimeout is how long updating an OPA waits for the bundle of the
+	// new registration to be activated, the update is abandoned after it.
+	updateTimeout = 30 * time.Second
+)
+
+// createOPARequest is a registration along with the ref to register it
+// under. The registration has the same fields as the OPAs in the server
+// config.
+type createOPARequest struct {
+	Ref string `json:"ref"`
+
+	config.OPA
+}
+
+type listOPAsResponse struct {
+	OPAs []opaResponse `json:"opas"`
+}
+
+// opaResponse describes a registered OPA, the secrets of its registration
+// are never included.
+type opaResponse struct {
+	Ref     string         `json:"ref"`
+	Ready   bool           `json:"ready"`
+	Config  config.OPA     `json:"config"`
+	Bundles []bundleStatus `json:"bundles"`
+	Cache   *cacheStats    `json:"cache,omitempty"`
+}
+
+// bundleStatus is the status of a bundle, times are omitted until the
+// bundle has first been downloaded or activated.
+type bundleStatus struct {
+	Name                     string     `json:"name"`
+	ActiveRevision           string     `json:"active_revision,omitempty"`
+	LastSuccessfulDownload   *time.Time `json:"last_successful_download,omitempty"`
+	LastSuccessfulActivation *time.Time `json:"last_successful_activation,omitempty"`
+	Errors                   []string   `json:"errors,omitempty"`
+}
+
+type cacheStats struct {
+	Size          int     `json:"size"`
+	Capacity      int     `json:"capacity"`
+	Hits          uint64  `json:"hits"`
+	Misses        uint64  `json:"misses"`
+	HitRatio      float64 `json:"hit_ratio"`
+	Evictions     uint64  `json:"evictions"`
+	Invalidations uint64  `json:"invalidations"`
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// describeOPA returns the description of the OPA with ref, ok is false when
+// it has been deleted.
+func describeOPA(m *opa.Manager, ref string) (resp opaResponse, ok bool) {
+	cfg := m.Config(ref)
+	status := m.Status(ref)
+	if cfg == nil || status == nil {
+		return resp, false
+	}
+
+	resp = opaResponse{
+		Ref:     ref,
+		Ready:   status.Ready,
+		Config:  cfg.Redacted(),
+		Bundles: []bundleStatus{},
+	}
+
+	if c := status.Cache; c != nil {
+		resp.Cache = &cacheStats{
+			Size:          c.Size,
+			Capacity:      c.Capacity,
+			Hits:          c.Hits,
+			Misses:        c.Misses,
+			HitRatio:      c.HitRatio(),
+			Evictions:     c.Evictions,
+			Invalidations: c.Invalidations,
+		}
+	}
+
+	for _, b := range status.Bundles {
+		s := bundleStatus{
+			Name:                     b.Name,
+			ActiveRevision:           b.ActiveRevision,
+			LastSuccessfulDownload:   timeOrNil(b.LastSuccessfulDownload),
+			LastSuccessfulActivation: timeOrNil(b.LastSuccessfulActivation),
+			Errors:                   b.Errors,
+		}
+		if b.Code != "" {
+			s.Errors = append([]string{b.Code + ": " + b.Message}, s.Errors...)
+		}
+
+		resp.Bundles = append(resp.Bundles, s)
+	}
+
+	return resp, true
+}
+
+// errNotJSON is returned when a registration is not sent as JSON.
+var errNotJSON = errors.New("request body must be sent as application/json")
+
+// decodeRegistration decodes a registration from the request body, unknown
+// fields are rejected so that misspelt settings are not silently ignored.
+// The body must be declared as JSON, browsers only send JSON to other sites
+// after a CORS preflight, so other sites cannot submit forms to the API with
+// the credentials of the user.
+func decodeRegistration(r *http.Request, v interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return errNotJSON
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(v)
+	if err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+
+	return nil
+}
+
+// checkSecretReferences rejects registrations using secret references, they
+// are only resolved from the config file as they could otherwise be used to
+// read secrets from the server.
+func checkSecretReferences(cfg config.OPA) error {
+	if len(cfg.SecretReferences()) > 0 {
+		return fmt.Errorf("secret references may only be used in the config file")
+	}
+
+	return nil
+}
+
+// checkSources rejects registrations with malformed system IDs or
+// endpoints. Missing values are left for the manager to report as they are
+// only required by some kinds of source.
+func checkSources(cfg config.OPA) error {
+	for _, b := range cfg.Sources() {
+		if b.SystemID != "" {
+			err := config.ValidateSystemID(b.SystemID)
+			if err != nil {
+				return fmt.Errorf("%w: %s", opa.ErrInvalidConfig, err)
+			}
+		}
+
+		if b.Endpoint != "" {
+			err := config.ValidateEndpoint(b.Endpoint)
+			if err != nil {
+				return fmt.Errorf("%w: %s", opa.ErrInvalidConfig, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// NewListOPAsHandler serves GET /api/v1/opas, describing all registered
+// OPAs ordered by ref.
+func NewListOPAsHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		refs := opts.OPAManager.List()
+		sort.Strings(refs)
+
+		resp := listOPAsResponse{OPAs: []opaResponse{}}
+		for _, ref := range refs {
+			// OPAs deleted since they were listed are skipped
+			o, ok := describeOPA(opts.OPAManager, ref)
+			if ok {
+				resp.OPAs = append(resp.OPAs, o)
+			}
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}, nil
+}
+
+// NewGetOPAHandler serves GET /api/v1/opas/{ref}, describing a single OPA.
+func NewGetOPAHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.PathValue("ref")
+
+		resp, ok := describeOPA(opts.OPAManager, ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s: %w", ref, opa.ErrNotFound))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}, nil
+}
+
+// NewCreateOPAHandler serves POST /api/v1/opas, registering a new OPA. The
+// response is sent once the bundle has been activated or addWaitTimeout has
+// passed, ready in the response reports which.
+func NewCreateOPAHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req createOPARequest
+
+		err := decodeRegistration(r, &req)
+		if errors.Is(err, errNotJSON) {
+			writeError(w, http.StatusUnsupportedMediaType, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = checkSecretReferences(req.OPA)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = config.ValidateRef(req.Ref)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = checkSources(req.OPA)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = req.OPA.ValidateRuntime(config.OPA{}, opts.FileSourceRoot)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = opts.OPAManager.Add(r.Context(), req.Ref, req.OPA, opa.WaitForActivation(addWaitTimeout), opa.Persist())
+		switch {
+		case errors.Is(err, opa.ErrAlreadyExists):
+			writeError(w, http.StatusConflict, err)
+			return
+		case errors.Is(err, opa.ErrInvalidConfig):
+			writeError(w, http.StatusBadRequest, err)
+			return
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		resp, ok := describeOPA(opts.OPAManager, req.Ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s: %w", req.Ref, opa.ErrNotFound))
+			return
+		}
+
+		w.Header().Set("Location", "/api/v1/opas/"+req.Ref)
+		writeJSON(w, http.StatusCreated, resp)
+	}, nil
+}
+
+// NewUpdateOPAHandler serves PUT /api/v1/opas/{ref}, replacing the
+// registration of an OPA. Secrets left blank are kept from the current
+// registration as described by config.OPA.WithSecretsFrom. The response is
+// sent once the bundle of the new registration has been activated.
+func NewUpdateOPAHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.PathValue("ref")
+
+		var cfg config.OPA
+
+		err := decodeRegistration(r, &cfg)
+		if errors.Is(err, errNotJSON) {
+			writeError(w, http.StatusUnsupportedMediaType, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = checkSecretReferences(cfg)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = checkSources(cfg)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		current := opts.OPAManager.Config(ref)
+		if current == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s: %w", ref, opa.ErrNotFound))
+			return
+		}
+
+		err = cfg.ValidateRuntime(*current, opts.FileSourceRoot)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), updateTimeout)
+		defer cancel()
+
+		err = opts.OPAManager.Update(ctx, ref, cfg.WithSecretsFrom(*current))
+		switch {
+		case errors.Is(err, opa.ErrNotFound):
+			writeError(w, http.StatusNotFound, err)
+			return
+		case errors.Is(err, opa.ErrInvalidConfig):
+			writeError(w, http.StatusBadRequest, err)
+			return
+		case errors.Is(err, context.DeadlineExceeded):
+			writeError(w, http.StatusGatewayTimeout, err)
+			return
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		resp, ok := describeOPA(opts.OPAManager, ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s: %w", ref, opa.ErrNotFound))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}, nil
+}
+
+// NewDeleteOPAHandler serves DELETE /api/v1/opas/{ref}, stopping and
+// removing an OPA.
+func NewDeleteOPAHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.PathValue("ref")
+
+		if opts.OPAManager.Config(ref) == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s: %w", ref, opa.ErrNotFound))
+			return
+		}
+
+		err := opts.OPAManager.Delete(r.Context(), ref)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}, nil
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+func TestOPAs(t *testing.T) {
+	modulePath := "policy/allow.rego"
+	exampleMod := `package policy
+default allow := true`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "rev-1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer example1-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := opa.NewManager()
+	defer m.Delete(context.Background(), "example1")
+
+	opts := &handlers.Options{
+		OPAManager: m,
+	}
+
+	mux := http.NewServeMux()
+	for pattern, build := range map[string]func(*handlers.Options) (http.HandlerFunc, error){
+		"GET /api/v1/opas":          NewListOPAsHandler,
+		"POST /api/v1/opas":         NewCreateOPAHandler,
+		"GET /api/v1/opas/{ref}":    NewGetOPAHandler,
+		"PUT /api/v1/opas/{ref}":    NewUpdateOPAHandler,
+		"DELETE /api/v1/opas/{ref}": NewDeleteOPAHandler,
+	} {
+		h, err := build(opts)
+		if err != nil {
+			t.Fatalf("unexpected error creating handler for %s: %s", pattern, err)
+		}
+		mux.Handle(pattern, h)
+	}
+
+	// steps run in order as each depends on the registrations made by the
+	// steps before it
+	steps := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		contentType    string
+		expectedStatus int
+		expectedCode   string
+		expectedBody   []string
+		absentBody     []string
+	}{
+		{
+			name:   "create",
+			method: http.MethodPost,
+			path:   "/api/v1/opas",
+			body: `{"ref": "example1", "system_id": "example1", "token": "example1-token", "endpoint": "` +
+				testServer.URL + `", "demo": {"label": "Example"}}`,
+			expectedStatus: http.StatusCreated,
+			expectedBody:   []string{`"ref":"example1"`, `"ready":true`, `"active_revision":"rev-1"`},
+			absentBody:     []string{"example1-token"},
+		},
+		{
+			name:           "create duplicate",
+			method:         http.MethodPost,
+			path:           "/api/v1/opas",
+			body:           `{"ref": "example1", "system_id": "example1", "token": "example1-token", "endpoint": "` + testServer.URL + `"}`,
+			expectedStatus: http.StatusConflict,
+			expectedCode:   "already_exists",
+		},
+		{
+			name:           "create invalid",
+			method:         http.MethodPost,
+			path:           "/api/v1/opas",
+			body:           `{"ref": "example2", "endpoint": "` + testServer.URL + `"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_config",
+		},
+		{
+			name:           "create unknown field",
+			method:         http.MethodPost,
+			path:           "/api/v1/opas",
+			body:           `{"ref": "example2", "sytem_id": "example2"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "bad_request",
+		},
+		{
+			name:           "create secret reference",
+			method:         http.MethodPost,
+			path:           "/api/v1/opas",
+			body:           `{"ref": "example2", "system_id": "example2", "token": "file:/etc/passwd", "endpoint": "` + testServer.URL + `"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "bad_request",
+		},
+		{
+			name:           "create invalid ref",
+			method:         http.MethodPost,
+			path:           "/api/v1/opas",
+			body:           `{"ref": "Example 2", "system_id": "example2", "token": "example2-token", "endpoint": "` + testServer.URL + `"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "bad_request",
+		},
+		{
+			name:           "create invalid endpoint",
+			method:         http.MethodPost,
+			path:           "/api/v1/opas",
+			body:           `{"ref": "example2", "system_id": "example2", "token": "example2-token", "endpoint": "ftp://example.com"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_config",
+		},
+		{
+			// a form on another site can only send JSON shaped text/plain
+			name:           "create not json",
+			method:         http.MethodPost,
+			path:           "/api/v1/opas",
+			body:           `{"ref": "example2", "system_id": "example2", "token": "example2-token", "endpoint": "` + testServer.URL + `"}`,
+			contentType:    "text/plain",
+			expectedStatus: http.StatusUnsupportedMediaType,
+			expectedCode:   "unsupported_media_type",
+		},
+		{
+			name:           "create decision log path",
+			method:         http.MethodPost,
+			path:           "/api/v1/opas",
+			body:           `{"ref": "example2", "system_id": "example2", "token": "example2-token", "endpoint": "` + testServer.URL + `", "decision_logs": {"path": "/tmp/decisions.log"}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "bad_request",
+		},
+		{
+			name:           "create file source",
+			method:         http.MethodPost,
+			path:           "/api/v1/opas",
+			body:           `{"ref": "example2", "kind": "file", "path": "/etc"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "bad_request",
+		},
+		{
+			name:           "create missing ref",
+			method:         http.MethodPost,
+			path:           "/api/v1/opas",
+			body:           `{"system_id": "example2"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "bad_request",
+		},
+		{
+			name:           "list",
+			method:         http.MethodGet,
+			path:           "/api/v1/opas",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`"opas":[{"ref":"example1"`, `"label":"Example"`},
+			absentBody:     []string{"example1-token"},
+		},
+		{
+			// the token is left out and must be kept for the same endpoint
+			name:           "update",
+			method:         http.MethodPut,
+			path:           "/api/v1/opas/example1",
+			body:           `{"system_id": "example1", "endpoint": "` + testServer.URL + `", "demo": {"label": "Updated"}}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`"ready":true`, `"label":"Updated"`},
+		},
+		{
+			name:           "update unknown",
+			method:         http.MethodPut,
+			path:           "/api/v1/opas/missing",
+			body:           `{"system_id": "missing", "endpoint": "` + testServer.URL + `"}`,
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   "not_found",
+		},
+		{
+			name:           "get",
+			method:         http.MethodGet,
+			path:           "/api/v1/opas/example1",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`"ref":"example1"`, `"label":"Updated"`},
+		},
+		{
+			name:           "delete",
+			method:         http.MethodDelete,
+			path:           "/api/v1/opas/example1",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "get deleted",
+			method:         http.MethodGet,
+			path:           "/api/v1/opas/example1",
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   "not_found",
+		},
+		{
+			name:           "delete deleted",
+			method:         http.MethodDelete,
+			path:           "/api/v1/opas/example1",
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   "not_found",
+		},
+	}
+
+	for _, step := range steps {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(step.method, step.path, strings.NewReader(step.body))
+		if step.body != "" {
+			contentType := step.contentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			req.Header.Set("Content-Type", contentType)
+		}
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != step.expectedStatus {
+			t.Fatalf("%s: unexpected status code: %d, body: %s", step.name, rr.Code, rr.Body.String())
+		}
+
+		if step.expectedCode != "" {
+			var resp struct {
+				Error string `json:"error"`
+				Code  string `json:"code"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatalf("%s: unexpected error decoding response: %s", step.name, err)
+			}
+
+			if resp.Code != step.expectedCode || resp.Error == "" {
+				t.Fatalf("%s: unexpected error response: %s", step.name, rr.Body.String())
+			}
+		}
+
+		for _, s := range step.expectedBody {
+			if !strings.Contains(rr.Body.String(), s) {
+				t.Fatalf("%s: expected %q to be present in %s", step.name, s, rr.Body.String())
+			}
+		}
+
+		for _, s := range step.absentBody {
+			if strings.Contains(rr.Body.String(), s) {
+				t.Fatalf("%s: expected %q not to be present", step.name, s)
+			}
+		}
+	}
+
+	if m.Config("example2") != nil {
+		t.Fatalf("expected invalid registrations not to be added")
+	}
+}
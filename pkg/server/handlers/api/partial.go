@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/sdk"
+	"github.com/open-policy-agent/opa/server/types"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+// partialRequest matches the request body of the OPA compile API.
+type partialRequest struct {
+	Query    string       `json:"query"`
+	Input    *interface{} `json:"input"`
+	Unknowns []string     `json:"unknowns"`
+}
+
+type partialResponse struct {
+	DecisionID string             `json:"decision_id"`
+	Result     partialResult      `json:"result"`
+	Provenance types.ProvenanceV1 `json:"provenance"`
+}
+
+// partialResult holds the residual queries of a partial evaluation, the
+// queries are empty when the query can never be true.
+type partialResult struct {
+	Queries []ast.Body    `json:"queries"`
+	Support []*ast.Module `json:"support,omitempty"`
+}
+
+// NewPartialHandler serves POST /api/v1/opas/{ref}/partial, partially
+// evaluating the query in the request body. The unknowns default to input,
+// as they do for the OPA compile API.
+func NewPartialHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.PathValue("ref")
+
+		var req partialRequest
+
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+
+		err := decoder.Decode(&req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+
+		if req.Query == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("query must be provided"))
+			return
+		}
+
+		options := sdk.PartialOptions{
+			Query:    req.Query,
+			Unknowns: req.Unknowns,
+		}
+		if req.Input != nil {
+			options.Input = *req.Input
+		}
+		if len(options.Unknowns) == 0 {
+			options.Unknowns = []string{"input"}
+		}
+
+		pr, err := opts.OPAManager.Partial(r.Context(), ref, options)
+		switch {
+		case errors.Is(err, opa.ErrNotFound):
+			writeError(w, http.StatusNotFound, err)
+			return
+		case errors.Is(err, opa.ErrNotReady):
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		case err != nil:
+			// partial evaluation fails when the query or unknowns in the
+			// request cannot be parsed or compiled
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		resp := partialResponse{
+			DecisionID: pr.ID,
+			Result: partialResult{
+				Queries: pr.AST.Queries,
+				Support: pr.AST.Support,
+			},
+			Provenance: pr.Provenance,
+		}
+		if resp.Result.Queries == nil {
+			resp.Result.Queries = []ast.Body{}
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}, nil
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+func TestPartial(t *testing.T) {
+	var err error
+
+	modulePath := "filters/allow.rego"
+	exampleMod := `package filters
+import rego.v1
+allow if input.user.role == "admin"
+allow if input.employee.name == input.user.name
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "rev-1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err = bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	ctx := context.Background()
+
+	m := opa.NewManager()
+	err = m.Add(
+		ctx,
+		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.URL,
+			},
+		},
+		opa.WaitForActivation(5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example1")
+
+	h, err := NewPartialHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating partial handler: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/v1/opas/{ref}/partial", h)
+
+	testCases := map[string]struct {
+		path            string
+		body            string
+		expectedStatus  int
+		expectedQueries []string
+	}{
+		"residual": {
+			path:            "/api/v1/opas/example1/partial",
+			body:            `{"query": "data.filters.allow == true", "input": {"user": {"name": "alice"}}, "unknowns": ["input.employee"]}`,
+			expectedStatus:  http.StatusOK,
+			expectedQueries: []string{`"alice" = input.employee.name`},
+		},
+		"always true": {
+			path:            "/api/v1/opas/example1/partial",
+			body:            `{"query": "data.filters.allow == true", "input": {"user": {"role": "admin"}}, "unknowns": ["input.employee"]}`,
+			expectedStatus:  http.StatusOK,
+			expectedQueries: []string{""},
+		},
+		"never true": {
+			path:            "/api/v1/opas/example1/partial",
+			body:            `{"query": "data.filters.allow == true", "input": {"user": {}}, "unknowns": ["input.employee"]}`,
+			expectedStatus:  http.StatusOK,
+			expectedQueries: []string{},
+		},
+		"default unknowns": {
+			path:            "/api/v1/opas/example1/partial",
+			body:            `{"query": "input.user.role == \"admin\""}`,
+			expectedStatus:  http.StatusOK,
+			expectedQueries: []string{`input.user.role = "admin"`},
+		},
+		"missing query": {
+			path:           "/api/v1/opas/example1/partial",
+			body:           `{"input": {}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		"invalid query": {
+			path:           "/api/v1/opas/example1/partial",
+			body:           `{"query": "data.filters.allow ==="}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		"unknown opa": {
+			path:           "/api/v1/opas/missing/partial",
+			body:           `{"query": "data.filters.allow == true"}`,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			mux.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("unexpected status code: %d, body: %s", rr.Code, rr.Body.String())
+			}
+
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				DecisionID string `json:"decision_id"`
+				Result     struct {
+					Queries []ast.Body `json:"queries"`
+				} `json:"result"`
+				Provenance struct {
+					Bundles map[string]struct {
+						Revision string `json:"revision"`
+					} `json:"bundles"`
+				} `json:"provenance"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatalf("unexpected error decoding response: %s", err)
+			}
+
+			if resp.DecisionID == "" {
+				t.Fatalf("expected a decision ID")
+			}
+
+			if resp.Provenance.Bundles["systems/example1"].Revision != "rev-1" {
+				t.Fatalf("unexpected provenance: %+v", resp.Provenance)
+			}
+
+			if len(resp.Result.Queries) != len(tc.expectedQueries) {
+				t.Fatalf("unexpected queries: %s", rr.Body.String())
+			}
+
+			for i, q := range resp.Result.Queries {
+				var exprs []string
+				for _, expr := range q {
+					exprs = append(exprs, expr.String())
+				}
+
+				if strings.Join(exprs, "; ") != tc.expectedQueries[i] {
+					t.Fatalf("unexpected query %d: %s", i, q)
+				}
+			}
+		})
+	}
+}
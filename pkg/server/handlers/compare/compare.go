@@ -0,0 +1,153 @@
+package compare
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/sdk"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+// defaultInput is shown in the input field until another is submitted.
+const defaultInput = `{"name": "alice"}`
+
+// row is a comparison prepared for the compare page.
+type row struct {
+	opa.Comparison
+
+	// Revision lists the bundle revisions as name@revision.
+	Revision string
+	// Result is the result formatted as JSON.
+	Result string
+	Error  string
+}
+
+func NewCompareHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	tmpl, err := template.ParseFS(
+		handlers.Templates,
+		"templates/compare/compare.html",
+		"templates/base.html",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %s", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		refs := opts.OPAManager.List()
+		sort.Strings(refs)
+
+		selected := map[string]bool{}
+		for _, ref := range query["ref"] {
+			selected[ref] = true
+		}
+
+		path := query.Get("path")
+		if path == "" {
+			path = config.DefaultDemoPath
+		}
+
+		input := query.Get("input")
+		if input == "" {
+			input = defaultInput
+		}
+
+		var err error
+		var rows []row
+		var formError string
+		status := http.StatusOK
+
+		if len(query["ref"]) > 0 {
+			rows, err = compare(r, opts.OPAManager, query["ref"], path, input)
+			if err != nil {
+				formError = err.Error()
+				status = http.StatusBadRequest
+			}
+		}
+
+		buf := new(bytes.Buffer)
+
+		err = tmpl.ExecuteTemplate(buf, "base", struct {
+			Opts     *handlers.Options
+			Refs     []string
+			Selected map[string]bool
+			Path     string
+			Input    string
+			Rows     []row
+			Error    string
+		}{
+			Opts:     opts,
+			Refs:     refs,
+			Selected: selected,
+			Path:     path,
+			Input:    input,
+			Rows:     rows,
+			Error:    formError,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(status)
+		w.Write(buf.Bytes())
+	}, nil
+}
+
+func compare(r *http.Request, manager *opa.Manager, refs []string, path, rawInput string) ([]row, error) {
+	var input interface{}
+
+	decoder := json.NewDecoder(strings.NewReader(rawInput))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&input)
+	if err != nil {
+		return nil, fmt.Errorf("input must be valid JSON: %w", err)
+	}
+
+	comparisons := manager.Compare(r.Context(), refs, sdk.DecisionOptions{
+		Path:  path,
+		Input: input,
+	})
+
+	rows := make([]row, len(comparisons))
+	for i, c := range comparisons {
+		rows[i] = row{Comparison: c}
+
+		revisions := make([]string, 0, len(c.Revisions))
+		for name, revision := range c.Revisions {
+			revisions = append(revisions, name+"@"+revision)
+		}
+		sort.Strings(revisions)
+		rows[i].Revision = strings.Join(revisions, ", ")
+
+		switch {
+		case c.Undefined():
+			rows[i].Result = "undefined"
+		case c.Err != nil:
+			rows[i].Error = c.Err.Error()
+		default:
+			bs, err := json.MarshalIndent(c.Result.Result, "", "  ")
+			if err != nil {
+				return nil, fmt.Errorf("failed to format result: %w", err)
+			}
+			rows[i].Result = string(bs)
+		}
+	}
+
+	return rows, nil
+}
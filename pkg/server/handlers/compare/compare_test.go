@@ -0,0 +1,186 @@
+package compare
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+func TestCompare(t *testing.T) {
+	modulePath := "policy/allow.rego"
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		names := `{"alice"}`
+		if r.URL.Path == "/bundles/systems/new" {
+			names = `{"bob"}`
+		}
+
+		mod := fmt.Sprintf(`package policy
+import rego.v1
+default allow := false
+allow if input.name in %s
+`, names)
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(bundle.Bundle{
+			Manifest: bundle.Manifest{
+				Revision: strings.TrimPrefix(r.URL.Path, "/bundles/systems/") + "-rev",
+			},
+			Modules: []bundle.ModuleFile{
+				{
+					URL:    modulePath,
+					Path:   modulePath,
+					Parsed: ast.MustParseModule(mod),
+					Raw:    []byte(mod),
+				},
+			},
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := opa.NewManager()
+
+	for _, ref := range []string{"old", "new"} {
+		err := m.Add(
+			context.Background(),
+			ref,
+			config.OPA{
+				Source: config.Source{
+					SystemID: ref,
+					Token:    "token",
+					Endpoint: testServer.URL,
+				},
+			},
+			opa.WaitForActivation(5*time.Second),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error adding OPA: %s", err)
+		}
+		defer m.Delete(context.Background(), ref)
+	}
+
+	h, err := NewCompareHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating compare handler: %s", err)
+	}
+
+	testCases := map[string]struct {
+		query            url.Values
+		expectedStatus   int
+		expectedContains []string
+		expectedMissing  []string
+	}{
+		"form only": {
+			query:            url.Values{},
+			expectedStatus:   http.StatusOK,
+			expectedContains: []string{`value="old"`, `value="new"`, "/policy/allow"},
+			expectedMissing:  []string{"Results"},
+		},
+		"differences": {
+			query: url.Values{
+				"ref":   {"old", "new"},
+				"path":  {"/policy/allow"},
+				"input": {`{"name": "alice"}`},
+			},
+			expectedStatus: http.StatusOK,
+			expectedContains: []string{
+				"systems/old@old-rev",
+				"systems/new@new-rev",
+				"bg-light-red",
+				"differs",
+			},
+		},
+		"same result": {
+			query: url.Values{
+				"ref":   {"old", "new"},
+				"input": {`{"name": "mallory"}`},
+			},
+			expectedStatus:   http.StatusOK,
+			expectedContains: []string{"false"},
+			expectedMissing:  []string{"bg-light-red"},
+		},
+		"invalid input": {
+			query: url.Values{
+				"ref":   {"old"},
+				"input": {`{"name": `},
+			},
+			expectedStatus:   http.StatusBadRequest,
+			expectedContains: []string{"input must be valid JSON"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/compare?"+tc.query.Encode(), nil)
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Log(rr.Body.String())
+				t.Fatalf("unexpected status code: %d", rr.Code)
+			}
+
+			for _, s := range tc.expectedContains {
+				if !strings.Contains(rr.Body.String(), s) {
+					t.Log(rr.Body.String())
+					t.Fatalf("expected %q to be present", s)
+				}
+			}
+
+			for _, s := range tc.expectedMissing {
+				if strings.Contains(rr.Body.String(), s) {
+					t.Log(rr.Body.String())
+					t.Fatalf("expected %q not to be present", s)
+				}
+			}
+		})
+	}
+
+	// requests are made concurrently so that any state shared between them
+	// is found by the race detector, and valid and invalid requests are
+	// mixed so that each must get its own status
+	t.Run("concurrent requests", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			tc := testCases["differences"]
+			if i%2 == 0 {
+				tc = testCases["invalid input"]
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				rr := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", "/compare?"+tc.query.Encode(), nil)
+				h.ServeHTTP(rr, req)
+
+				if rr.Code != tc.expectedStatus {
+					t.Errorf("unexpected status code: %d", rr.Code)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
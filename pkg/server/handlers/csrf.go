@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+)
+
+const (
+	// CSRFFieldName is the form field forms submit the CSRF token in.
+	CSRFFieldName = "csrf_token"
+
+	// CSRFHeaderName is the header scripts may submit the CSRF token in
+	// instead of the form field.
+	CSRFHeaderName = "X-CSRF-Token"
+
+	csrfCookieName = "csrf_token"
+	csrfTokenBytes = 32
+)
+
+// CSRFToken returns the CSRF token of the session of r, a new session is
+// started with a new token when r does not have one. It must be called
+// before the response is written as the token is set in a cookie.
+func CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if token, ok := csrfCookie(r); ok {
+		return token, nil
+	}
+
+	bs := make([]byte, csrfTokenBytes)
+	_, err := rand.Read(bs)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate csrf token: %w", err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(bs)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return token, nil
+}
+
+// csrfCookie returns the token of the session of r, ok is false when r has
+// no session or the cookie does not hold a token.
+func csrfCookie(r *http.Request) (string, bool) {
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil || len(bs) != csrfTokenBytes {
+		return "", false
+	}
+
+	return c.Value, true
+}
+
+// NewCSRFMiddleware returns middleware which rejects requests changing state
+// that do not submit the CSRF token of their session, as other sites cannot
+// read the token they are unable to submit forms on behalf of users. Safe
+// methods are always allowed. Rejected requests are shown an error page.
+func NewCSRFMiddleware(opts *Options) (func(http.Handler) http.Handler, error) {
+	tmpl, err := template.ParseFS(
+		Templates,
+		"templates/error.html",
+		"templates/base.html",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %s", err)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if validCSRFToken(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			buf := bytes.NewBuffer([]byte{})
+
+			err := tmpl.ExecuteTemplate(buf, "base", struct {
+				Opts    *Options
+				Title   string
+				Message string
+			}{
+				Opts:  opts,
+				Title: "Request rejected",
+				Message: "The form could not be verified, it may have expired or been submitted " +
+					"from another site. Go back, reload the page and try again.",
+			})
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, err = w.Write([]byte(err.Error()))
+				return
+			}
+
+			w.WriteHeader(http.StatusForbidden)
+			_, err = io.Copy(w, buf)
+		})
+	}, nil
+}
+
+func validCSRFToken(r *http.Request) bool {
+	expected, ok := csrfCookie(r)
+	if !ok {
+		return false
+	}
+
+	submitted := r.Header.Get(CSRFHeaderName)
+	if submitted == "" {
+		submitted = r.PostFormValue(CSRFFieldName)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(submitted), []byte(expected)) == 1
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFToken(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/opas", nil)
+
+	token, err := CSRFToken(rr, req)
+	if err != nil {
+		t.Fatalf("unexpected error getting token: %s", err)
+	}
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != token || !cookies[0].HttpOnly {
+		t.Fatalf("unexpected cookies: %+v", cookies)
+	}
+
+	// the token of an existing session is reused
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/opas", nil)
+	req.AddCookie(cookies[0])
+
+	reused, err := CSRFToken(rr, req)
+	if err != nil {
+		t.Fatalf("unexpected error getting token: %s", err)
+	}
+
+	if reused != token {
+		t.Fatalf("expected the token of the session to be reused")
+	}
+
+	if len(rr.Result().Cookies()) != 0 {
+		t.Fatalf("expected no new cookie to be set")
+	}
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	csrf, err := NewCSRFMiddleware(&Options{})
+	if err != nil {
+		t.Fatalf("unexpected error creating middleware: %s", err)
+	}
+
+	h := csrf(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := httptest.NewRecorder()
+	token, err := CSRFToken(rr, httptest.NewRequest(http.MethodGet, "/opas", nil))
+	if err != nil {
+		t.Fatalf("unexpected error getting token: %s", err)
+	}
+	cookie := rr.Result().Cookies()[0]
+
+	testCases := map[string]struct {
+		method         string
+		cookie         bool
+		field          string
+		header         string
+		expectedStatus int
+	}{
+		"get without token": {
+			method:         http.MethodGet,
+			expectedStatus: http.StatusOK,
+		},
+		"post with token": {
+			method:         http.MethodPost,
+			cookie:         true,
+			field:          token,
+			expectedStatus: http.StatusOK,
+		},
+		"post with header": {
+			method:         http.MethodPost,
+			cookie:         true,
+			header:         token,
+			expectedStatus: http.StatusOK,
+		},
+		"post without token": {
+			method:         http.MethodPost,
+			cookie:         true,
+			expectedStatus: http.StatusForbidden,
+		},
+		"post with wrong token": {
+			method:         http.MethodPost,
+			cookie:         true,
+			field:          token + "x",
+			expectedStatus: http.StatusForbidden,
+		},
+		"post without session": {
+			method:         http.MethodPost,
+			field:          token,
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			form := url.Values{}
+			form.Set("_method", "DELETE")
+			form.Set("ref", "example1")
+			if tc.field != "" {
+				form.Set(CSRFFieldName, tc.field)
+			}
+
+			req := httptest.NewRequest(tc.method, "/opas", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tc.cookie {
+				req.AddCookie(cookie)
+			}
+			if tc.header != "" {
+				req.Header.Set(CSRFHeaderName, tc.header)
+			}
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("unexpected status code: %d", rr.Code)
+			}
+
+			if rr.Code == http.StatusForbidden && !strings.Contains(rr.Body.String(), "Request rejected") {
+				t.Fatalf("expected the error page to be present: %s", rr.Body.String())
+			}
+		})
+	}
+}
@@ -2,13 +2,19 @@ package demo
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
 
 	"github.com/open-policy-agent/opa/sdk"
 
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
 	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
 )
 
@@ -26,52 +32,95 @@ func NewDemoHandler(opts *handlers.Options) (http.HandlerFunc, error) {
 		return nil, fmt.Errorf("failed to parse templates: %s", err)
 	}
 
+	notReadyTmpl, err := template.ParseFS(
+		handlers.Templates,
+		"templates/demo/not_ready.html",
+		"templates/base.html",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %s", err)
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		ref := strings.TrimPrefix(r.URL.Path, "/demo/")
 
-		opaInstance := opts.OPAManager.Get(ref)
-		if opaInstance == nil {
+		if opts.OPAManager.Get(ref) == nil {
 			w.WriteHeader(http.StatusNotFound)
 			_, err = w.Write([]byte("OPA instance not found"))
 			return
 		}
 
-		name := "alice"
-		if r.URL.Query().Get("name") != "" {
-			name = r.URL.Query().Get("name")
+		if !opts.OPAManager.Ready(ref) {
+			buf := new(bytes.Buffer)
+
+			err = notReadyTmpl.ExecuteTemplate(buf, "base", struct {
+				Opts *handlers.Options
+				Ref  string
+				Path string
+			}{
+				Opts: opts,
+				Ref:  ref,
+				Path: r.URL.Path,
+			})
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, err = w.Write([]byte(err.Error()))
+				return
+			}
+
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(buf.Bytes())
+
+			return
 		}
 
-		dr, err := opaInstance.Decision(r.Context(), sdk.DecisionOptions{
-			Path: "/policy/allow",
-			Input: map[string]interface{}{
-				"name": name,
-			},
-		})
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, err = w.Write([]byte(err.Error()))
+		cfg := opts.OPAManager.Config(ref)
+		if cfg == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, err = w.Write([]byte("OPA instance not found"))
 			return
 		}
 
-		result, ok := dr.Result.(bool)
-		if !ok {
+		demo := cfg.Demo.WithDefaults()
+		if demo.Label == "" {
+			demo.Label = ref
+		}
+
+		d, err := evaluate(r.Context(), opts.OPAManager, ref, demo, r.URL.Query())
+		if errors.Is(err, errInvalidInput) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			_, err = w.Write([]byte("unexpected decision result"))
+			_, err = w.Write([]byte(err.Error()))
 			return
 		}
 
+		// the stream is told which revisions the page was rendered with so
+		// that it can send activations made before it was opened
+		query := r.URL.Query()
+		query.Set(renderedRevisionParam, d.Revision)
+		eventsPath := fmt.Sprintf("/demo/%s/events?%s", url.PathEscape(ref), query.Encode())
+
 		buf := new(bytes.Buffer)
 
 		err = tmpl.ExecuteTemplate(buf, "base", struct {
-			Opts    *handlers.Options
-			Name    string
-			Path    string
-			Allowed bool
+			Opts         *handlers.Options
+			Label        string
+			DecisionPath string
+			Path         string
+			EventsPath   string
+			Decision     decision
 		}{
-			Opts:    opts,
-			Name:    name,
-			Path:    r.URL.Path,
-			Allowed: result,
+			Opts:         opts,
+			Label:        demo.Label,
+			DecisionPath: demo.Path,
+			Path:         r.URL.Path,
+			EventsPath:   eventsPath,
+			Decision:     d,
 		})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -84,3 +133,69 @@ func NewDemoHandler(opts *handlers.Options) (http.HandlerFunc, error) {
 		return
 	}, nil
 }
+
+// errInvalidInput is returned by evaluate when the submitted input does not
+// match the demo fields.
+var errInvalidInput = errors.New("invalid input")
+
+// decision is a demo decision prepared for the demo page.
+type decision struct {
+	Fields []fieldValue
+	Result resultView
+
+	// Revision lists the revisions of the bundles the decision was evaluated
+	// against as name@revision.
+	Revision string
+
+	// Live is true when the decision is sent to the page because a bundle
+	// has been activated, it is flashed to show it has changed.
+	Live bool
+}
+
+// evaluate evaluates the demo decision for the input submitted in query.
+func evaluate(
+	ctx context.Context,
+	manager *opa.Manager,
+	ref string,
+	demo config.Demo,
+	query url.Values,
+) (decision, error) {
+	var d decision
+
+	input, fields, err := buildInput(demo.Fields, query)
+	if err != nil {
+		return d, fmt.Errorf("%w: %s", errInvalidInput, err)
+	}
+	d.Fields = fields
+
+	dr, err := manager.Decision(ctx, ref, sdk.DecisionOptions{
+		Path:  demo.Path,
+		Input: input,
+	})
+	undefined := sdk.IsUndefinedErr(err)
+	if err != nil && !undefined {
+		return d, err
+	}
+
+	var result interface{}
+	if !undefined {
+		result = dr.Result
+	}
+
+	d.Result, err = newResultView(result, undefined)
+	if err != nil {
+		return d, err
+	}
+
+	if dr != nil {
+		revisions := make([]string, 0, len(dr.Provenance.Bundles))
+		for name, b := range dr.Provenance.Bundles {
+			revisions = append(revisions, name+"@"+b.Revision)
+		}
+		sort.Strings(revisions)
+
+		d.Revision = strings.Join(revisions, ", ")
+	}
+
+	return d, nil
+}
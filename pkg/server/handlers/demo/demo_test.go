@@ -13,6 +13,7 @@ import (
 	"github.com/open-policy-agent/opa/bundle"
 
 	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
 	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
 )
 
@@ -63,9 +64,14 @@ allow if input.name in {"alice", "bob"}
 	err = m.Add(
 		ctx,
 		"example1",
-		"example1",
-		"example1-token",
-		testServer.Listener.Addr().String(),
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.Listener.Addr().String(),
+			},
+		},
+		opa.WaitForActivation(2*time.Second),
 	)
 	if err != nil {
 		t.Fatalf("unexpected error adding OPA: %s", err)
@@ -98,3 +104,300 @@ allow if input.name in {"alice", "bob"}
 		t.Fatalf("expected example1 to be present")
 	}
 }
+
+func TestDemoNotReady(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := opa.NewManager()
+	err := m.Add(
+		context.Background(),
+		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.Listener.Addr().String(),
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	h, err := NewDemoHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating demo handler: %s", err)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/demo/example1", nil)
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status code: %d", rr.Code)
+	}
+
+	if !strings.Contains(rr.Body.String(), "has not been loaded yet") {
+		t.Log(rr.Body.String())
+		t.Fatalf("expected not loaded message to be present")
+	}
+}
+
+func TestDemoSettings(t *testing.T) {
+	var err error
+
+	modulePath := "rbac/allow.rego"
+	exampleMod := `package rbac
+import rego.v1
+default allow := false
+allow if {
+	input.user.role == "admin"
+	input.request.size < 10
+	not input.request.dry_run
+}
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err = bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := opa.NewManager()
+	err = m.Add(
+		context.Background(),
+		"rbac",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "rbac",
+				Token:    "rbac-token",
+				Endpoint: testServer.URL,
+			},
+			Demo: config.Demo{
+				Label: "Role based access",
+				Path:  "/rbac/allow",
+				Fields: []config.DemoField{
+					{Name: "user.role", Default: "admin"},
+					{Name: "request.size", Type: config.DemoFieldNumber, Default: "5"},
+					{Name: "request.dry_run", Type: config.DemoFieldBoolean, Default: "false"},
+				},
+			},
+		},
+		opa.WaitForActivation(5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	h, err := NewDemoHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating demo handler: %s", err)
+	}
+
+	testCases := map[string]struct {
+		query            string
+		expectedStatus   int
+		expectedContains []string
+	}{
+		"defaults": {
+			expectedStatus: http.StatusOK,
+			expectedContains: []string{
+				"Role based access",
+				"/rbac/allow",
+				`name="user.role"`,
+				`type="number"`,
+				"admin, 5, false is allowed",
+			},
+		},
+		"submitted values": {
+			query:            "?user.role=viewer&request.size=5&request.dry_run=false",
+			expectedStatus:   http.StatusOK,
+			expectedContains: []string{"viewer, 5, false is not allowed"},
+		},
+		"boolean": {
+			query:            "?request.dry_run=true",
+			expectedStatus:   http.StatusOK,
+			expectedContains: []string{"admin, 5, true is not allowed"},
+		},
+		"invalid number": {
+			query:            "?request.size=large",
+			expectedStatus:   http.StatusBadRequest,
+			expectedContains: []string{"request.size must be a number"},
+		},
+		"non JSON number": {
+			query:            "?request.size=NaN",
+			expectedStatus:   http.StatusBadRequest,
+			expectedContains: []string{"request.size must be a number"},
+		},
+		"hexadecimal number": {
+			query:            "?request.size=0x1p4",
+			expectedStatus:   http.StatusBadRequest,
+			expectedContains: []string{"request.size must be a number"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/demo/rbac"+tc.query, nil)
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Log(rr.Body.String())
+				t.Fatalf("unexpected status code: %d", rr.Code)
+			}
+
+			for _, s := range tc.expectedContains {
+				if !strings.Contains(rr.Body.String(), s) {
+					t.Log(rr.Body.String())
+					t.Fatalf("expected %q to be present", s)
+				}
+			}
+		})
+	}
+}
+
+func TestDemoResultShapes(t *testing.T) {
+	var err error
+
+	modulePath := "policy/results.rego"
+	exampleMod := `package policy
+import rego.v1
+deny contains "name must not be mallory" if input.name == "mallory"
+decision := {"allow": input.name != "mallory", "reasons": deny}
+count_names := 3
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err = bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := opa.NewManager()
+
+	h, err := NewDemoHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating demo handler: %s", err)
+	}
+
+	testCases := map[string]struct {
+		path             string
+		query            string
+		expectedContains []string
+	}{
+		"violations": {
+			path:             "/policy/deny",
+			query:            "?name=mallory",
+			expectedContains: []string{"mallory is not allowed", "<li>name must not be mallory</li>"},
+		},
+		"no violations": {
+			path:             "/policy/deny",
+			expectedContains: []string{"alice is allowed"},
+		},
+		"allow with reasons": {
+			path:             "/policy/decision",
+			query:            "?name=mallory",
+			expectedContains: []string{"mallory is not allowed", "<li>name must not be mallory</li>"},
+		},
+		"number": {
+			path:             "/policy/count_names",
+			expectedContains: []string{"<pre", "3</pre>"},
+		},
+		"undefined": {
+			path:             "/policy/missing",
+			expectedContains: []string{"The decision is undefined for alice"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ref := strings.ReplaceAll(name, " ", "-")
+
+			err := m.Add(
+				context.Background(),
+				ref,
+				config.OPA{
+					Source: config.Source{
+						SystemID: "example",
+						Token:    "example-token",
+						Endpoint: testServer.URL,
+					},
+					Demo: config.Demo{Path: tc.path},
+				},
+				opa.WaitForActivation(5*time.Second),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error adding OPA: %s", err)
+			}
+			defer m.Delete(context.Background(), ref)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/demo/"+ref+tc.query, nil)
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Log(rr.Body.String())
+				t.Fatalf("unexpected status code: %d", rr.Code)
+			}
+
+			for _, s := range tc.expectedContains {
+				if !strings.Contains(rr.Body.String(), s) {
+					t.Log(rr.Body.String())
+					t.Fatalf("expected %q to be present", s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package demo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+const (
+	// keepAliveInterval is how often a comment is sent to keep idle event
+	// streams open through proxies.
+	keepAliveInterval = 15 * time.Second
+
+	// renderedRevisionParam is the query parameter holding the revisions
+	// the demo page was rendered with. Demo field names cannot start with a
+	// dot, so it is never mistaken for a field.
+	renderedRevisionParam = ".revision"
+)
+
+// NewDemoEventsHandler serves GET /demo/{ref}/events, a stream of server sent
+// events which re-renders the demo decision for the input in the query each
+// time the OPA activates a bundle. Events are only sent when the rendered
+// decision has changed.
+func NewDemoEventsHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("missing required options")
+	}
+
+	tmpl, err := template.ParseFS(
+		handlers.Templates,
+		"templates/demo/demo.html",
+		"templates/base.html",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %s", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.PathValue("ref")
+
+		if opts.OPAManager.Get(ref) == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("OPA instance not found"))
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("streaming is not supported"))
+			return
+		}
+
+		events, unsubscribe := opts.OPAManager.Subscribe(ref)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		query := r.URL.Query()
+		rendered, hasRendered := query.Get(renderedRevisionParam), query.Has(renderedRevisionParam)
+		query.Del(renderedRevisionParam)
+
+		var last decision
+
+		// send sends the current decision if it differs from the last one
+		// sent, false is returned when the stream has been closed
+		send := func() bool {
+			d, err := evaluateCurrent(r.Context(), opts, ref, query)
+			if err != nil || reflect.DeepEqual(d, last) {
+				return true
+			}
+			last = d
+
+			d.Live = true
+
+			buf := new(bytes.Buffer)
+			err = tmpl.ExecuteTemplate(buf, "decision", d)
+			if err != nil {
+				return true
+			}
+
+			err = writeEvent(w, "decision", buf.String())
+			if err != nil {
+				return false
+			}
+			flusher.Flush()
+
+			return true
+		}
+
+		// the page was rendered with the decision of the rendered revisions,
+		// which is only sent if bundles were activated before the stream
+		// was opened
+		last, _ = evaluateCurrent(r.Context(), opts, ref, query)
+		if hasRendered && last.Revision != rendered {
+			last = decision{}
+			if !send() {
+				return
+			}
+		}
+
+		keepAlive := time.NewTicker(keepAliveInterval)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				_, err := w.Write([]byte(": keep-alive\n\n"))
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-events:
+				if !send() {
+					return
+				}
+			}
+		}
+	}, nil
+}
+
+// evaluateCurrent evaluates the demo decision with the current settings of
+// the OPA, which may have been changed since the stream was opened.
+func evaluateCurrent(ctx context.Context, opts *handlers.Options, ref string, query url.Values) (decision, error) {
+	cfg := opts.OPAManager.Config(ref)
+	if cfg == nil {
+		return decision{}, fmt.Errorf("OPA instance not found")
+	}
+
+	return evaluate(ctx, opts.OPAManager, ref, cfg.Demo.WithDefaults(), query)
+}
+
+// writeEvent writes a server sent event, each line of data is sent as a
+// separate data field.
+func writeEvent(w http.ResponseWriter, event, data string) error {
+	buf := new(bytes.Buffer)
+
+	fmt.Fprintf(buf, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
@@ -0,0 +1,214 @@
+package demo
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+func TestDemoEvents(t *testing.T) {
+	modulePath := "policy/allow.rego"
+
+	newBundle := func(revision, name string) *bundle.Bundle {
+		mod := fmt.Sprintf(`package policy
+import rego.v1
+default allow := false
+allow if input.name == %q
+`, name)
+
+		return &bundle.Bundle{
+			Manifest: bundle.Manifest{
+				Revision: revision,
+			},
+			Modules: []bundle.ModuleFile{
+				{
+					URL:    modulePath,
+					Path:   modulePath,
+					Parsed: ast.MustParseModule(mod),
+					Raw:    []byte(mod),
+				},
+			},
+		}
+	}
+
+	var bundleLock sync.Mutex
+	currentBundle := newBundle("1", "alice")
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		bundleLock.Lock()
+		defer bundleLock.Unlock()
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*currentBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	bundleServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer bundleServer.Close()
+
+	ctx := context.Background()
+
+	m := opa.NewManager()
+	err := m.Add(
+		ctx,
+		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: bundleServer.URL,
+				Trigger:  config.TriggerManual,
+			},
+		},
+		opa.WaitForActivation(5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example1")
+
+	h, err := NewDemoEventsHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating demo events handler: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /demo/{ref}/events", h)
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	resp, err := http.Get(testServer.URL + "/demo/example1/events?name=bob")
+	if err != nil {
+		t.Fatalf("unexpected error opening event stream: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan string)
+	go func() {
+		defer close(events)
+
+		scanner := bufio.NewScanner(resp.Body)
+
+		var event strings.Builder
+		for scanner.Scan() {
+			if scanner.Text() == "" {
+				events <- event.String()
+				event.Reset()
+				continue
+			}
+			event.WriteString(scanner.Text() + "\n")
+		}
+	}()
+
+	// refreshing the same revision does not change the decision, so no
+	// event is sent for it
+	err = m.Refresh(ctx, "example1")
+	if err != nil {
+		t.Fatalf("unexpected error refreshing OPA: %s", err)
+	}
+
+	bundleLock.Lock()
+	currentBundle = newBundle("2", "bob")
+	bundleLock.Unlock()
+
+	err = m.Refresh(ctx, "example1")
+	if err != nil {
+		t.Fatalf("unexpected error refreshing OPA: %s", err)
+	}
+
+	select {
+	case event := <-events:
+		if !strings.HasPrefix(event, "event: decision\n") {
+			t.Fatalf("unexpected event: %s", event)
+		}
+
+		for _, s := range []string{"bob is allowed", "systems/example1@2", "flash"} {
+			if !strings.Contains(event, s) {
+				t.Fatalf("expected %q to be present in event: %s", s, event)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a decision event")
+	}
+
+	// a stream opened for a page rendered before the activation is sent the
+	// current decision straight away
+	stale, err := http.Get(testServer.URL + "/demo/example1/events?name=bob&.revision=systems%2Fexample1%401")
+	if err != nil {
+		t.Fatalf("unexpected error opening event stream: %s", err)
+	}
+	defer stale.Body.Close()
+
+	staleEvents := make(chan string)
+	go func() {
+		defer close(staleEvents)
+
+		scanner := bufio.NewScanner(stale.Body)
+
+		var event strings.Builder
+		for scanner.Scan() {
+			if scanner.Text() == "" {
+				staleEvents <- event.String()
+				event.Reset()
+				continue
+			}
+			event.WriteString(scanner.Text() + "\n")
+		}
+	}()
+
+	select {
+	case event := <-staleEvents:
+		if !strings.Contains(event, "systems/example1@2") {
+			t.Fatalf("expected the current revision in event: %s", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a decision event for the stale page")
+	}
+}
+
+func TestDemoEventsNotFound(t *testing.T) {
+	h, err := NewDemoEventsHandler(&handlers.Options{
+		OPAManager: opa.NewManager(),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating demo events handler: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /demo/{ref}/events", h)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/demo/missing/events", nil)
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code: %d", rr.Code)
+	}
+}
@@ -0,0 +1,214 @@
+package demo
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/open-policy-agent/opa/sdk"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+//go:embed data/employees.json
+var sampleData embed.FS
+
+// sampleTable is the name of the table holding the sample dataset.
+const sampleTable = "employees"
+
+// sampleColumns are the columns of the sample dataset in display order.
+var sampleColumns = []string{"id", "name", "department", "role", "salary", "remote"}
+
+// defaults for the filter form, the query is partially evaluated with each
+// employee unknown to find the employees alice is allowed to see.
+const (
+	defaultFilterQuery   = "data.filters.allow == true"
+	defaultFilterUnknown = "input.employee"
+	defaultFilterInput   = `{"user": {"name": "alice", "department": "engineering", "role": "manager"}}`
+)
+
+// filterForm holds the values of the filter form.
+type filterForm struct {
+	Query   string
+	Unknown string
+	Input   string
+}
+
+// filterResult is a partial evaluation prepared for the filter page.
+type filterResult struct {
+	Queries []string
+	SQL     string
+	Rows    [][]interface{}
+	Total   int
+}
+
+func NewDemoFilterHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("missing required options")
+	}
+
+	tmpl, err := template.ParseFS(
+		handlers.Templates,
+		"templates/demo/filter.html",
+		"templates/base.html",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %s", err)
+	}
+
+	bs, err := sampleData.ReadFile("data/employees.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sample data: %s", err)
+	}
+
+	var rows []map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(bs))
+	decoder.UseNumber()
+
+	err = decoder.Decode(&rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sample data: %s", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ref := r.PathValue("ref")
+
+		if opts.OPAManager.Get(ref) == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, err = w.Write([]byte("OPA instance not found"))
+			return
+		}
+
+		query := r.URL.Query()
+
+		form := filterForm{
+			Query:   query.Get("query"),
+			Unknown: query.Get("unknown"),
+			Input:   query.Get("input"),
+		}
+		if form.Query == "" {
+			form.Query = defaultFilterQuery
+		}
+		if form.Unknown == "" {
+			form.Unknown = defaultFilterUnknown
+		}
+		if form.Input == "" {
+			form.Input = defaultFilterInput
+		}
+
+		status := http.StatusOK
+		var formError string
+
+		result, err := filter(r, opts.OPAManager, ref, form, rows)
+		switch {
+		case errors.Is(err, opa.ErrNotReady):
+			w.Header().Set("Retry-After", "1")
+			status = http.StatusServiceUnavailable
+			formError = err.Error()
+		case err != nil:
+			status = http.StatusBadRequest
+			formError = err.Error()
+		}
+
+		buf := new(bytes.Buffer)
+
+		err = tmpl.ExecuteTemplate(buf, "base", struct {
+			Opts     *handlers.Options
+			Ref      string
+			DemoPath string
+			Path     string
+			Form     filterForm
+			Table    string
+			Columns  []string
+			Result   *filterResult
+			Error    string
+		}{
+			Opts:     opts,
+			Ref:      ref,
+			DemoPath: "/demo/" + url.PathEscape(ref),
+			Path:     r.URL.Path,
+			Form:     form,
+			Table:    sampleTable,
+			Columns:  sampleColumns,
+			Result:   result,
+			Error:    formError,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(status)
+		w.Write(buf.Bytes())
+	}, nil
+}
+
+// filter partially evaluates the query of form with its unknown and applies
+// the residual queries to rows as a SQL filter.
+func filter(
+	r *http.Request,
+	manager *opa.Manager,
+	ref string,
+	form filterForm,
+	rows []map[string]interface{},
+) (*filterResult, error) {
+	var input interface{}
+
+	decoder := json.NewDecoder(strings.NewReader(form.Input))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&input)
+	if err != nil {
+		return nil, fmt.Errorf("input must be valid JSON: %w", err)
+	}
+
+	pr, err := manager.Partial(r.Context(), ref, sdk.PartialOptions{
+		Query:    form.Query,
+		Input:    input,
+		Unknowns: []string{form.Unknown},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &filterResult{
+		Total: len(rows),
+	}
+
+	for _, body := range pr.AST.Queries {
+		result.Queries = append(result.Queries, body.String())
+	}
+
+	f, err := translateSQL(pr.AST, form.Unknown, sampleTable)
+	if err != nil {
+		return result, err
+	}
+
+	result.SQL = fmt.Sprintf("SELECT * FROM %s WHERE %s", quoteIdentifier(sampleTable), f.where())
+
+	for _, row := range rows {
+		if !f.matches(row) {
+			continue
+		}
+
+		values := make([]interface{}, len(sampleColumns))
+		for i, column := range sampleColumns {
+			values[i] = row[column]
+		}
+
+		result.Rows = append(result.Rows, values)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,153 @@
+package demo
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+func TestDemoFilter(t *testing.T) {
+	modulePath := "filters/allow.rego"
+	exampleMod := `package filters
+import rego.v1
+allow if input.user.role == "admin"
+allow if {
+	input.user.role == "manager"
+	input.employee.department == input.user.department
+}
+allow if input.employee.name == input.user.name
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	ctx := context.Background()
+
+	m := opa.NewManager()
+	err := m.Add(
+		ctx,
+		"filters",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "filters",
+				Token:    "filters-token",
+				Endpoint: testServer.URL,
+			},
+		},
+		opa.WaitForActivation(5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "filters")
+
+	h, err := NewDemoFilterHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating demo filter handler: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /demo/{ref}/filter", h)
+
+	testCases := map[string]struct {
+		path                string
+		expectedStatus      int
+		expectedContains    []string
+		expectedNotContains []string
+	}{
+		"manager": {
+			path:           "/demo/filters/filter",
+			expectedStatus: http.StatusOK,
+			expectedContains: []string{
+				"SELECT * FROM &#34;employees&#34; WHERE (",
+				"(&#34;employees&#34;.&#34;department&#34; = &#39;engineering&#39;)",
+				"(&#34;employees&#34;.&#34;name&#34; = &#39;alice&#39;)",
+				"3 of 8 rows match",
+				"carol",
+			},
+			expectedNotContains: []string{"dave"},
+		},
+		"admin": {
+			path:             "/demo/filters/filter?input=" + url.QueryEscape(`{"user": {"name": "dave", "role": "admin"}}`),
+			expectedStatus:   http.StatusOK,
+			expectedContains: []string{"WHERE TRUE", "8 of 8 rows match"},
+		},
+		"employee": {
+			path:             "/demo/filters/filter?input=" + url.QueryEscape(`{"user": {"name": "erin", "role": "associate"}}`),
+			expectedStatus:   http.StatusOK,
+			expectedContains: []string{"WHERE &#34;employees&#34;.&#34;name&#34; = &#39;erin&#39;", "1 of 8 rows match"},
+		},
+		"invalid input": {
+			path:             "/demo/filters/filter?input=nope",
+			expectedStatus:   http.StatusBadRequest,
+			expectedContains: []string{"input must be valid JSON"},
+		},
+		"missing": {
+			path:           "/demo/missing/filter",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tc.path, nil)
+			mux.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Log(rr.Body.String())
+				t.Fatalf("unexpected status code: %d", rr.Code)
+			}
+
+			for _, s := range tc.expectedContains {
+				if !strings.Contains(rr.Body.String(), s) {
+					t.Log(rr.Body.String())
+					t.Fatalf("expected %q to be present", s)
+				}
+			}
+
+			for _, s := range tc.expectedNotContains {
+				if strings.Contains(rr.Body.String(), s) {
+					t.Log(rr.Body.String())
+					t.Fatalf("expected %q not to be present", s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package demo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+)
+
+// fieldValue is a demo form field along with its current value.
+type fieldValue struct {
+	config.DemoField
+	Value string
+}
+
+// buildInput returns the input document for the demo fields, taking values
+// from the query and falling back to the field defaults.
+func buildInput(fields []config.DemoField, query url.Values) (map[string]interface{}, []fieldValue, error) {
+	input := map[string]interface{}{}
+	values := make([]fieldValue, 0, len(fields))
+
+	for _, f := range fields {
+		fv := fieldValue{DemoField: f, Value: f.Default}
+		if query.Has(f.Name) {
+			fv.Value = query.Get(f.Name)
+		}
+		values = append(values, fv)
+
+		var value interface{} = fv.Value
+		switch f.Type {
+		case config.DemoFieldNumber:
+			if fv.Value == "" {
+				continue
+			}
+
+			if !config.IsJSONNumber(fv.Value) {
+				return nil, values, fmt.Errorf("%s must be a number", f.Name)
+			}
+			value = json.Number(fv.Value)
+		case config.DemoFieldBoolean:
+			if fv.Value == "" {
+				continue
+			}
+
+			b, err := strconv.ParseBool(fv.Value)
+			if err != nil {
+				return nil, values, fmt.Errorf("%s must be true or false", f.Name)
+			}
+			value = b
+		}
+
+		setInput(input, strings.Split(f.Name, "."), value)
+	}
+
+	return input, values, nil
+}
+
+// setInput sets the value at the path of keys, creating objects as needed.
+func setInput(input map[string]interface{}, keys []string, value interface{}) {
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := input[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			input[key] = next
+		}
+		input = next
+	}
+
+	input[keys[len(keys)-1]] = value
+}
@@ -0,0 +1,109 @@
+package demo
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+const (
+	// resultBoolean is a result of true or false.
+	resultBoolean = "boolean"
+	// resultViolations is a set or array of messages, the input is allowed
+	// when it is empty.
+	resultViolations = "violations"
+	// resultAllowReasons is an object with a boolean allow and an optional
+	// set or array of reasons.
+	resultAllowReasons = "allow_reasons"
+	// resultUndefined is shown when the decision is undefined.
+	resultUndefined = "undefined"
+	// resultJSON is any other result, shown as JSON.
+	resultJSON = "json"
+)
+
+// resultView is a decision result prepared for the demo page.
+type resultView struct {
+	Kind     string
+	Allowed  bool
+	Messages []string
+	JSON     string
+}
+
+// newResultView picks the presentation for result based on its shape.
+func newResultView(result interface{}, undefined bool) (resultView, error) {
+	if undefined {
+		return resultView{Kind: resultUndefined}, nil
+	}
+
+	switch r := result.(type) {
+	case bool:
+		return resultView{Kind: resultBoolean, Allowed: r}, nil
+	case []interface{}:
+		if messages, ok := stringList(r); ok {
+			return resultView{
+				Kind:     resultViolations,
+				Allowed:  len(messages) == 0,
+				Messages: messages,
+			}, nil
+		}
+	case map[string]interface{}:
+		if view, ok := allowReasons(r); ok {
+			return view, nil
+		}
+	}
+
+	bs, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return resultView{}, fmt.Errorf("failed to format result: %w", err)
+	}
+
+	return resultView{Kind: resultJSON, JSON: string(bs)}, nil
+}
+
+// allowReasons returns the view of an object of the form
+// {"allow": bool, "reasons": [string]}, reasons may be omitted.
+func allowReasons(r map[string]interface{}) (resultView, bool) {
+	allow, ok := r["allow"].(bool)
+	if !ok {
+		return resultView{}, false
+	}
+
+	view := resultView{Kind: resultAllowReasons, Allowed: allow}
+
+	for key, value := range r {
+		switch key {
+		case "allow":
+		case "reasons":
+			values, ok := value.([]interface{})
+			if !ok {
+				return resultView{}, false
+			}
+
+			view.Messages, ok = stringList(values)
+			if !ok {
+				return resultView{}, false
+			}
+		default:
+			return resultView{}, false
+		}
+	}
+
+	return view, true
+}
+
+// stringList returns the values as a sorted list of strings, sets are
+// returned as arrays in no particular order.
+func stringList(values []interface{}) ([]string, bool) {
+	messages := make([]string, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		messages = append(messages, s)
+	}
+
+	sort.Strings(messages)
+
+	return messages, true
+}
@@ -0,0 +1,86 @@
+package demo
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestNewResultView(t *testing.T) {
+	testCases := map[string]struct {
+		result    interface{}
+		undefined bool
+		expected  resultView
+	}{
+		"undefined": {
+			undefined: true,
+			expected:  resultView{Kind: resultUndefined},
+		},
+		"allowed": {
+			result:   true,
+			expected: resultView{Kind: resultBoolean, Allowed: true},
+		},
+		"denied": {
+			result:   false,
+			expected: resultView{Kind: resultBoolean},
+		},
+		"no violations": {
+			result:   []interface{}{},
+			expected: resultView{Kind: resultViolations, Allowed: true, Messages: []string{}},
+		},
+		"violations": {
+			result: []interface{}{"b is missing", "a is too large"},
+			expected: resultView{
+				Kind:     resultViolations,
+				Messages: []string{"a is too large", "b is missing"},
+			},
+		},
+		"allow with reasons": {
+			result: map[string]interface{}{
+				"allow":   false,
+				"reasons": []interface{}{"not an admin"},
+			},
+			expected: resultView{
+				Kind:     resultAllowReasons,
+				Messages: []string{"not an admin"},
+			},
+		},
+		"allow without reasons": {
+			result: map[string]interface{}{
+				"allow": true,
+			},
+			expected: resultView{Kind: resultAllowReasons, Allowed: true},
+		},
+		"object with other keys": {
+			result: map[string]interface{}{
+				"allow": true,
+				"limit": json.Number("10"),
+			},
+			expected: resultView{
+				Kind: resultJSON,
+				JSON: "{\n  \"allow\": true,\n  \"limit\": 10\n}",
+			},
+		},
+		"number": {
+			result:   json.Number("42"),
+			expected: resultView{Kind: resultJSON, JSON: "42"},
+		},
+		"mixed array": {
+			result:   []interface{}{"a", json.Number("1")},
+			expected: resultView{Kind: resultJSON, JSON: "[\n  \"a\",\n  1\n]"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			view, err := newResultView(tc.result, tc.undefined)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !reflect.DeepEqual(view, tc.expected) {
+				t.Fatalf("unexpected view: %#v", view)
+			}
+		})
+	}
+}
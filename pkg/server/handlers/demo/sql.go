@@ -0,0 +1,335 @@
+package demo
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// sqlOperators maps the comparison built-ins found in residual queries to
+// their SQL operators.
+var sqlOperators = map[string]string{
+	ast.Equality.Name:      "=",
+	ast.Equal.Name:         "=",
+	ast.NotEqual.Name:      "<>",
+	ast.LessThan.Name:      "<",
+	ast.LessThanEq.Name:    "<=",
+	ast.GreaterThan.Name:   ">",
+	ast.GreaterThanEq.Name: ">=",
+}
+
+// flippedOperators are the operators used when the operands of a comparison
+// are swapped so that the column is on the left.
+var flippedOperators = map[string]string{
+	"=":  "=",
+	"<>": "<>",
+	"<":  ">",
+	"<=": ">=",
+	">":  "<",
+	">=": "<=",
+}
+
+// negatedOperators are the operators used for negated comparisons. As values
+// are always ordered, not a < b holds exactly when a >= b does.
+var negatedOperators = map[string]string{
+	"=":  "<>",
+	"<>": "=",
+	"<":  ">=",
+	"<=": ">",
+	">":  "<=",
+	">=": "<",
+}
+
+// sqlFilter is the translation of the residual queries of a partial
+// evaluation, rows match when any of the queries match.
+type sqlFilter struct {
+	table   string
+	queries [][]sqlCondition
+}
+
+// sqlCondition compares a column of a row with a value. A NULL column is
+// compared as OPA compares null, which is only equal to null and is ordered
+// before all other values, so unlike SQL comparisons with NULL, conditions
+// are always either true or false.
+type sqlCondition struct {
+	column   string
+	operator string
+	value    interface{}
+}
+
+// translateSQL translates the residual queries of a partial evaluation into a
+// filter on table. References to the unknown become columns of table, so
+// with the unknown input.employee, input.employee.name is the name column.
+func translateSQL(pq *rego.PartialQueries, unknown, table string) (*sqlFilter, error) {
+	if len(pq.Support) > 0 {
+		return nil, fmt.Errorf("residual queries with support modules cannot be translated to SQL")
+	}
+
+	prefix, err := ast.ParseRef(unknown)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unknown %q: %w", unknown, err)
+	}
+
+	f := &sqlFilter{table: table}
+
+	for _, body := range pq.Queries {
+		conditions := make([]sqlCondition, 0, len(body))
+
+		for _, expr := range body {
+			// conditions which always hold do not filter anything
+			if term, ok := expr.Terms.(*ast.Term); ok && !expr.Negated && term.Value.Compare(ast.Boolean(true)) == 0 {
+				continue
+			}
+
+			c, err := translateExpr(expr, prefix)
+			if err != nil {
+				return nil, err
+			}
+
+			conditions = append(conditions, c)
+		}
+
+		f.queries = append(f.queries, conditions)
+	}
+
+	return f, nil
+}
+
+func translateExpr(expr *ast.Expr, prefix ast.Ref) (sqlCondition, error) {
+	var c sqlCondition
+
+	if len(expr.With) > 0 || !expr.IsCall() || len(expr.Operands()) != 2 {
+		return c, fmt.Errorf("expression %s cannot be translated to SQL", expr)
+	}
+
+	operator, ok := sqlOperators[expr.Operator().String()]
+	if !ok {
+		return c, fmt.Errorf("operator %s cannot be translated to SQL", expr.Operator())
+	}
+
+	left, right := expr.Operand(0), expr.Operand(1)
+
+	column, ok := columnName(left, prefix)
+	valueTerm := right
+	if !ok {
+		column, ok = columnName(right, prefix)
+		valueTerm = left
+		operator = flippedOperators[operator]
+	}
+	if !ok {
+		return c, fmt.Errorf("expression %s does not compare a column of the unknown", expr)
+	}
+
+	if expr.Negated {
+		operator = negatedOperators[operator]
+	}
+
+	value, err := ast.JSON(valueTerm.Value)
+	if err != nil {
+		return c, fmt.Errorf("expression %s does not compare a column with a value", expr)
+	}
+
+	switch value.(type) {
+	case string, json.Number, bool, nil:
+	default:
+		return c, fmt.Errorf("expression %s does not compare a column with a value", expr)
+	}
+
+	return sqlCondition{
+		column:   column,
+		operator: operator,
+		value:    value,
+	}, nil
+}
+
+// columnName returns the column referenced by term, references start with
+// the unknown and may iterate over it, such as input.employees[_].name.
+func columnName(term *ast.Term, prefix ast.Ref) (string, bool) {
+	ref, ok := term.Value.(ast.Ref)
+	if !ok || !ref.HasPrefix(prefix) {
+		return "", false
+	}
+
+	rest := ref[len(prefix):]
+	if len(rest) > 0 {
+		if _, ok := rest[0].Value.(ast.Var); ok {
+			rest = rest[1:]
+		}
+	}
+
+	if len(rest) != 1 {
+		return "", false
+	}
+
+	column, ok := rest[0].Value.(ast.String)
+	if !ok {
+		return "", false
+	}
+
+	return string(column), true
+}
+
+// where returns the filter as the condition of a SQL WHERE clause.
+func (f *sqlFilter) where() string {
+	if len(f.queries) == 0 {
+		return "FALSE"
+	}
+
+	queries := make([]string, 0, len(f.queries))
+	for _, conditions := range f.queries {
+		if len(conditions) == 0 {
+			return "TRUE"
+		}
+
+		sql := make([]string, 0, len(conditions))
+		for _, c := range conditions {
+			sql = append(sql, c.sql(f.table))
+		}
+
+		queries = append(queries, strings.Join(sql, " AND "))
+	}
+
+	if len(queries) == 1 {
+		return queries[0]
+	}
+
+	return "(" + strings.Join(queries, ") OR (") + ")"
+}
+
+func (c sqlCondition) sql(table string) string {
+	column := quoteIdentifier(table) + "." + quoteIdentifier(c.column)
+
+	if c.value == nil {
+		switch c.operator {
+		case "=", "<=":
+			return column + " IS NULL"
+		case "<>", ">":
+			return column + " IS NOT NULL"
+		case "<":
+			return "FALSE"
+		default:
+			return "TRUE"
+		}
+	}
+
+	s := column + " " + c.operator + " " + sqlValue(c.value)
+
+	// NULL is less than and not equal to all other values, which SQL leaves
+	// unknown
+	switch c.operator {
+	case "<>", "<", "<=":
+		return "(" + column + " IS NULL OR " + s + ")"
+	default:
+		return s
+	}
+}
+
+// quoteIdentifier quotes name so that it is used as a table or column name
+// whatever characters it contains.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func sqlValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	default:
+		return "NULL"
+	}
+}
+
+// matches returns true if row is selected by the filter.
+func (f *sqlFilter) matches(row map[string]interface{}) bool {
+	for _, conditions := range f.queries {
+		matched := true
+		for _, c := range conditions {
+			if !c.matches(row) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c sqlCondition) matches(row map[string]interface{}) bool {
+	o := order(row[c.column], c.value)
+
+	switch c.operator {
+	case "=":
+		return o == 0
+	case "<>":
+		return o != 0
+	case "<":
+		return o < 0
+	case "<=":
+		return o <= 0
+	case ">":
+		return o > 0
+	case ">=":
+		return o >= 0
+	default:
+		return false
+	}
+}
+
+// order returns -1, 0 or 1 as a is less than, equal to or greater than b.
+// Values are ordered as OPA orders them, values of different types are
+// ordered null, booleans, numbers and then strings. Missing columns are
+// null.
+func order(a, b interface{}) int {
+	if o := cmp.Compare(typeRank(a), typeRank(b)); o != 0 {
+		return o
+	}
+
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case json.Number:
+		x, _ := a.Float64()
+		y, _ := b.(json.Number).Float64()
+		return cmp.Compare(x, y)
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case a:
+			return 1
+		default:
+			return -1
+		}
+	default:
+		return 0
+	}
+}
+
+// typeRank returns the position of the type of v in the order of types.
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case json.Number:
+		return 2
+	default:
+		return 3
+	}
+}
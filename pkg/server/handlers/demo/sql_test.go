@@ -0,0 +1,197 @@
+package demo
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestTranslateSQL(t *testing.T) {
+	// erin has no department, which is NULL in SQL and null in OPA
+	rows := []map[string]interface{}{
+		{"name": "alice", "department": "engineering", "salary": json.Number("120000")},
+		{"name": "bob", "department": "engineering", "salary": json.Number("95000")},
+		{"name": "dave", "department": "sales", "salary": json.Number("110000")},
+		{"name": "erin", "department": nil, "salary": json.Number("90000")},
+	}
+
+	testCases := map[string]struct {
+		queries       []string
+		unknown       string
+		expectedWhere string
+		expectedNames []string
+		expectError   bool
+	}{
+		"never true": {
+			unknown:       "input.employee",
+			expectedWhere: "FALSE",
+		},
+		"always true": {
+			queries:       []string{"true"},
+			unknown:       "input.employee",
+			expectedWhere: "TRUE",
+			expectedNames: []string{"alice", "bob", "dave", "erin"},
+		},
+		"conjunction": {
+			queries:       []string{`input.employee.department = "engineering"; input.employee.salary < 100000`},
+			unknown:       "input.employee",
+			expectedWhere: `"employees"."department" = 'engineering' AND ("employees"."salary" IS NULL OR "employees"."salary" < 100000)`,
+			expectedNames: []string{"bob"},
+		},
+		"value on the left": {
+			queries:       []string{`100000 < input.employee.salary`},
+			unknown:       "input.employee",
+			expectedWhere: `"employees"."salary" > 100000`,
+			expectedNames: []string{"alice", "dave"},
+		},
+		"disjunction": {
+			queries:       []string{`input.employee.name == "alice"`, `not input.employee.department = "engineering"`},
+			unknown:       "input.employee",
+			expectedWhere: `("employees"."name" = 'alice') OR (("employees"."department" IS NULL OR "employees"."department" <> 'engineering'))`,
+			expectedNames: []string{"alice", "dave", "erin"},
+		},
+		"iteration": {
+			queries:       []string{`data.employees[x].name != "bob"`},
+			unknown:       "data.employees",
+			expectedWhere: `("employees"."name" IS NULL OR "employees"."name" <> 'bob')`,
+			expectedNames: []string{"alice", "dave", "erin"},
+		},
+		"quoting": {
+			queries:       []string{`input.employee.name = "o'brien"`},
+			unknown:       "input.employee",
+			expectedWhere: `"employees"."name" = 'o''brien'`,
+		},
+		"quoted column": {
+			queries:       []string{`input.employee["na\"me"] = "alice"`},
+			unknown:       "input.employee",
+			expectedWhere: `"employees"."na""me" = 'alice'`,
+		},
+		// null is only equal to null and is ordered before all other values
+		"null column not equal": {
+			queries:       []string{`input.employee.department != "sales"`},
+			unknown:       "input.employee",
+			expectedWhere: `("employees"."department" IS NULL OR "employees"."department" <> 'sales')`,
+			expectedNames: []string{"alice", "bob", "erin"},
+		},
+		"null column ordered": {
+			queries:       []string{`input.employee.department < "f"`},
+			unknown:       "input.employee",
+			expectedWhere: `("employees"."department" IS NULL OR "employees"."department" < 'f')`,
+			expectedNames: []string{"alice", "bob", "erin"},
+		},
+		"null column negated": {
+			queries:       []string{`not input.employee.department < "f"`},
+			unknown:       "input.employee",
+			expectedWhere: `"employees"."department" >= 'f'`,
+			expectedNames: []string{"dave"},
+		},
+		"null value": {
+			queries:       []string{`input.employee.department = null`},
+			unknown:       "input.employee",
+			expectedWhere: `"employees"."department" IS NULL`,
+			expectedNames: []string{"erin"},
+		},
+		"unsupported call": {
+			queries:     []string{`startswith(input.employee.name, "a")`},
+			unknown:     "input.employee",
+			expectError: true,
+		},
+		"nested column": {
+			queries:     []string{`input.employee.address.city = "london"`},
+			unknown:     "input.employee",
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			pq := &rego.PartialQueries{}
+			for _, q := range tc.queries {
+				pq.Queries = append(pq.Queries, ast.MustParseBody(q))
+			}
+
+			f, err := translateSQL(pq, tc.unknown, "employees")
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if f.where() != tc.expectedWhere {
+				t.Fatalf("unexpected where clause: %s", f.where())
+			}
+
+			var names []string
+			for _, row := range rows {
+				if f.matches(row) {
+					names = append(names, row["name"].(string))
+				}
+
+				// rows must match exactly when OPA finds the queries true
+				// for them
+				if tc.unknown == "input.employee" && f.matches(row) != opaMatches(t, tc.queries, row) {
+					t.Fatalf("expected the filter to match %v as OPA does", row)
+				}
+			}
+
+			if len(names) != len(tc.expectedNames) {
+				t.Fatalf("unexpected matching rows: %v", names)
+			}
+			for i := range names {
+				if names[i] != tc.expectedNames[i] {
+					t.Fatalf("unexpected matching rows: %v", names)
+				}
+			}
+		})
+	}
+}
+
+// opaMatches returns true if OPA finds any of queries true with row as
+// input.employee.
+func opaMatches(t *testing.T, queries []string, row map[string]interface{}) bool {
+	bs, err := json.Marshal(map[string]interface{}{"employee": row})
+	if err != nil {
+		t.Fatalf("unexpected error encoding row: %s", err)
+	}
+
+	var input interface{}
+	err = util.UnmarshalJSON(bs, &input)
+	if err != nil {
+		t.Fatalf("unexpected error decoding row: %s", err)
+	}
+
+	for _, q := range queries {
+		rs, err := rego.New(
+			rego.Query(q),
+			rego.Input(input),
+		).Eval(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error evaluating %s: %s", q, err)
+		}
+
+		// queries of a single comparison result in its value rather than
+		// being undefined when it is false
+		for _, r := range rs {
+			matched := true
+			for _, e := range r.Expressions {
+				if e.Value != true {
+					matched = false
+				}
+			}
+
+			if matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
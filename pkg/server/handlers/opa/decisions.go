@@ -0,0 +1,159 @@
+package opa
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+// decisionFilter selects the decisions listed on the decisions page, empty
+// fields match all decisions.
+type decisionFilter struct {
+	// Path matches decisions with a path containing it.
+	Path string
+	// Revision matches decisions evaluated against a revision containing it.
+	Revision string
+	// Text matches decisions with an input or result containing it.
+	Text string
+}
+
+func (f decisionFilter) matches(d decisionRow) bool {
+	return strings.Contains(d.Path, f.Path) &&
+		strings.Contains(d.Revision, f.Revision) &&
+		(strings.Contains(d.Input, f.Text) || strings.Contains(d.Result, f.Text))
+}
+
+// decisionRow is a decision prepared for the decisions page.
+type decisionRow struct {
+	Timestamp time.Time
+
+	// Path is the query of partial evaluations, which have no path.
+	Path      string
+	Input     string
+	Result    string
+	Undefined bool
+	Error     string
+	Revision  string
+	Latency   time.Duration
+	Cached    bool
+}
+
+func newDecisionRow(d opa.DecisionLog) (decisionRow, error) {
+	row := decisionRow{
+		Timestamp: d.Timestamp,
+		Path:      d.Path,
+		Undefined: d.Undefined,
+		Error:     d.Error,
+		Revision:  d.Revision(),
+		Latency:   d.Latency,
+		Cached:    d.Cached,
+	}
+
+	if row.Path == "" {
+		row.Path = d.Query
+	}
+
+	input, err := json.MarshalIndent(d.Input, "", "  ")
+	if err != nil {
+		return row, fmt.Errorf("failed to format input of decision %s: %w", d.ID, err)
+	}
+	row.Input = string(input)
+
+	if !d.Undefined && d.Error == "" {
+		result, err := json.MarshalIndent(d.Result, "", "  ")
+		if err != nil {
+			return row, fmt.Errorf("failed to format result of decision %s: %w", d.ID, err)
+		}
+		row.Result = string(result)
+	}
+
+	return row, nil
+}
+
+func NewOPADecisionsHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	tmpl, err := template.ParseFS(
+		handlers.Templates,
+		"templates/opa/decisions.html",
+		"templates/base.html",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %s", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.PathValue("ref")
+
+		decisions, err := opts.OPAManager.Decisions(ref)
+		if errors.Is(err, opa.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+
+		filter := decisionFilter{
+			Path:     r.URL.Query().Get("path"),
+			Revision: r.URL.Query().Get("revision"),
+			Text:     r.URL.Query().Get("q"),
+		}
+
+		rows := make([]decisionRow, 0, len(decisions))
+		for _, d := range decisions {
+			row, err := newDecisionRow(d)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, err = w.Write([]byte(err.Error()))
+				return
+			}
+
+			if filter.matches(row) {
+				rows = append(rows, row)
+			}
+		}
+
+		buf := bytes.NewBuffer([]byte{})
+
+		err = tmpl.ExecuteTemplate(buf, "base", struct {
+			Opts   *handlers.Options
+			Ref    string
+			Filter decisionFilter
+			Total  int
+			Rows   []decisionRow
+		}{
+			Opts:   opts,
+			Ref:    ref,
+			Filter: filter,
+			Total:  len(decisions),
+			Rows:   rows,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+
+		_, err = io.Copy(w, buf)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+	}, nil
+}
@@ -0,0 +1,154 @@
+package opa
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/sdk"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+)
+
+func TestOPADecisions(t *testing.T) {
+	modulePath := "policy/allow.rego"
+	exampleMod := `package policy
+import rego.v1
+default allow := false
+allow if input.name == "alice"
+`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(exampleMod),
+				Raw:    []byte(exampleMod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	ctx := context.Background()
+
+	m := opa.NewManager()
+	err := m.Add(
+		ctx,
+		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.URL,
+			},
+		},
+		opa.WaitForActivation(5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example1")
+
+	for _, name := range []string{"alice", "bob"} {
+		_, err = m.Decision(ctx, "example1", sdk.DecisionOptions{
+			Path:  "/policy/allow",
+			Input: map[string]interface{}{"name": name},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error making decision: %s", err)
+		}
+	}
+
+	h, err := NewOPADecisionsHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating OPA decisions handler: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /opas/{ref}/decisions", h)
+
+	testCases := map[string]struct {
+		path                string
+		expectedStatus      int
+		expectedContains    []string
+		expectedNotContains []string
+	}{
+		"all": {
+			path:           "/opas/example1/decisions",
+			expectedStatus: http.StatusOK,
+			expectedContains: []string{
+				"Showing 2 of the 2",
+				"/policy/allow",
+				"&#34;alice&#34;",
+				"&#34;bob&#34;",
+				"systems/example1@1",
+			},
+		},
+		"text filter": {
+			path:                "/opas/example1/decisions?q=bob",
+			expectedStatus:      http.StatusOK,
+			expectedContains:    []string{"Showing 1 of the 2", "&#34;bob&#34;", "false"},
+			expectedNotContains: []string{"&#34;alice&#34;"},
+		},
+		"path filter": {
+			path:             "/opas/example1/decisions?path=/policy/deny",
+			expectedStatus:   http.StatusOK,
+			expectedContains: []string{"Showing 0 of the 2"},
+		},
+		"missing": {
+			path:           "/opas/missing/decisions",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tc.path, nil)
+			mux.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Log(rr.Body.String())
+				t.Fatalf("unexpected status code: %d", rr.Code)
+			}
+
+			for _, s := range tc.expectedContains {
+				if !strings.Contains(rr.Body.String(), s) {
+					t.Log(rr.Body.String())
+					t.Fatalf("expected %q to be present", s)
+				}
+			}
+
+			for _, s := range tc.expectedNotContains {
+				if strings.Contains(rr.Body.String(), s) {
+					t.Log(rr.Body.String())
+					t.Fatalf("expected %q not to be present", s)
+				}
+			}
+		})
+	}
+}
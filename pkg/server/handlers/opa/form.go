@@ -0,0 +1,300 @@
+package opa
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+)
+
+// formErrors maps form fields to the reason they are invalid so that they
+// can be shown next to the fields, it is returned as the error of the form
+// helpers when any field is invalid.
+type formErrors map[string]string
+
+// add records the error of field, only the first error of each field is
+// kept.
+func (e formErrors) add(field, format string, args ...any) {
+	if _, ok := e[field]; ok {
+		return
+	}
+
+	e[field] = fmt.Sprintf(format, args...)
+}
+
+// merge adds the errors of err to e, errors which are not formErrors are
+// recorded against the form as a whole.
+func (e formErrors) merge(err error) {
+	var errs formErrors
+	if !errors.As(err, &errs) {
+		if err != nil {
+			e.add("", "%s", err)
+		}
+		return
+	}
+
+	for field, msg := range errs {
+		e.add(field, "%s", msg)
+	}
+}
+
+// err returns e as an error, or nil when no field is invalid.
+func (e formErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+func (e formErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for f := range e {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	msgs := make([]string, 0, len(fields))
+	for _, f := range fields {
+		msgs = append(msgs, e[f])
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// sourceFromForm reads and validates the source fields of the create and
+// edit forms. When the form leaves a secret blank, the one of current is
+// kept so that the edit form does not need to echo secrets back to the
+// browser. Invalid fields are returned as formErrors.
+func sourceFromForm(form url.Values, current config.Source) (config.Source, error) {
+	source := config.Source{
+		Kind:     form.Get("kind"),
+		Endpoint: strings.TrimSpace(form.Get("endpoint")),
+		Token:    form.Get("token"),
+		SystemID: strings.TrimSpace(form.Get("system_id")),
+		Resource: form.Get("resource"),
+		Path:     form.Get("path"),
+		Trigger:  form.Get("trigger"),
+
+		Reference: form.Get("reference"),
+		Username:  form.Get("username"),
+		Password:  form.Get("password"),
+
+		Verification: config.Verification{
+			KeyID:     form.Get("key_id"),
+			PublicKey: form.Get("public_key"),
+			Secret:    form.Get("verification_secret"),
+			Algorithm: form.Get("algorithm"),
+			Scope:     form.Get("scope"),
+		},
+	}
+
+	errs := formErrors{}
+
+	// secret references are only resolved from the config file, as they
+	// could otherwise be used to read secrets from the server
+	for _, name := range []string{"token", "password", "verification_secret"} {
+		if config.IsSecretReference(form.Get(name)) {
+			errs.add(name, "%s must not be a secret reference, references may only be used in the config file", name)
+		}
+	}
+
+	for _, f := range []struct {
+		name  string
+		value *int64
+	}{
+		{"min_delay_seconds", &source.Polling.MinDelaySeconds},
+		{"max_delay_seconds", &source.Polling.MaxDelaySeconds},
+		{"long_polling_timeout_seconds", &source.Polling.LongPollingTimeoutSeconds},
+	} {
+		if form.Get(f.name) == "" {
+			continue
+		}
+
+		var err error
+		*f.value, err = strconv.ParseInt(form.Get(f.name), 10, 64)
+		if err != nil || *f.value < 0 {
+			errs.add(f.name, "%s must be a positive number of seconds", f.name)
+		}
+	}
+
+	if source.Polling.MaxDelaySeconds != 0 && source.Polling.MinDelaySeconds > source.Polling.MaxDelaySeconds {
+		errs.add("min_delay_seconds", "min_delay_seconds must not be greater than max_delay_seconds")
+	}
+
+	if source.Kind == "" {
+		source.Kind = config.SourceKindDAS
+	}
+
+	source = source.WithSecretsFrom(current)
+
+	v := &source.Verification
+	if v.Enabled() {
+		if v.KeyID == "" {
+			errs.add("key_id", "key_id must be provided to verify bundles")
+		}
+
+		if (v.PublicKey == "") == (v.Secret == "") {
+			errs.add("public_key", "one of public_key or verification_secret must be provided to verify bundles")
+		}
+	}
+
+	switch source.Kind {
+	case config.SourceKindDAS:
+		if err := config.ValidateSystemID(source.SystemID); err != nil {
+			errs.add("system_id", "%s", err)
+		}
+
+		if source.Token == "" {
+			errs.add("token", "token must be provided")
+		}
+	case config.SourceKindHTTP:
+		if source.Resource == "" {
+			errs.add("resource", "resource must be provided")
+		}
+	case config.SourceKindFile:
+		if source.Path == "" {
+			errs.add("path", "path must be provided")
+		}
+	case config.SourceKindOCI:
+		if source.Reference == "" {
+			errs.add("reference", "reference must be provided")
+		}
+	default:
+		errs.add("kind", "kind must be one of das, http, file or oci")
+	}
+
+	switch source.Trigger {
+	case config.TriggerPeriodic, config.TriggerManual:
+	case "":
+		source.Trigger = config.TriggerPeriodic
+	default:
+		errs.add("trigger", "trigger must be one of periodic or manual")
+	}
+
+	if source.Endpoint != "" || (source.Kind != config.SourceKindFile && source.Kind != config.SourceKindOCI) {
+		if err := config.ValidateEndpoint(source.Endpoint); err != nil {
+			errs.add("endpoint", "%s", err)
+		}
+	}
+
+	return source, errs.err()
+}
+
+// demoFromForm reads the demo settings of the create and edit forms. Fields
+// are given one per line as name, name:type or name:type=default. Invalid
+// settings are returned as formErrors.
+func demoFromForm(form url.Values) (config.Demo, error) {
+	demo := config.Demo{
+		Label: strings.TrimSpace(form.Get("demo_label")),
+		Path:  strings.TrimSpace(form.Get("demo_path")),
+	}
+
+	for _, line := range strings.Split(form.Get("demo_fields"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		var field config.DemoField
+
+		spec, def, _ := strings.Cut(line, "=")
+		field.Name, field.Type, _ = strings.Cut(strings.TrimSpace(spec), ":")
+		field.Name = strings.TrimSpace(field.Name)
+		field.Type = strings.TrimSpace(field.Type)
+		field.Default = strings.TrimSpace(def)
+
+		demo.Fields = append(demo.Fields, field)
+	}
+
+	if demo.Path != "" && !strings.HasPrefix(demo.Path, "/") {
+		return demo, formErrors{"demo_path": "demo path must start with /"}
+	}
+
+	err := demo.Validate()
+	if err != nil {
+		return demo, formErrors{"demo_fields": err.Error()}
+	}
+
+	return demo, nil
+}
+
+// formatDemoFields formats fields in the format read by demoFromForm.
+func formatDemoFields(fields []config.DemoField) string {
+	lines := make([]string, 0, len(fields))
+	for _, f := range fields {
+		line := f.Name
+		if f.Type != "" {
+			line += ":" + f.Type
+		}
+		if f.Default != "" {
+			line += "=" + f.Default
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// cacheFromForm reads the decision cache size of the create and edit forms,
+// caching is disabled when it is blank.
+func cacheFromForm(form url.Values) (config.Cache, error) {
+	var cache config.Cache
+
+	value := strings.TrimSpace(form.Get("cache_size"))
+	if value == "" {
+		return cache, nil
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 {
+		return cache, formErrors{"cache_size": "cache_size must be a positive number of decisions"}
+	}
+	cache.Size = size
+
+	return cache, nil
+}
+
+// formFromConfig returns the edit form values of cfg, secrets are left out
+// as they are kept when the form leaves them blank.
+func formFromConfig(cfg config.OPA) url.Values {
+	form := url.Values{}
+
+	for name, value := range map[string]string{
+		"kind":       cfg.Kind,
+		"endpoint":   cfg.Endpoint,
+		"system_id":  cfg.SystemID,
+		"resource":   cfg.Resource,
+		"path":       cfg.Path,
+		"trigger":    cfg.Trigger,
+		"reference":  cfg.Reference,
+		"username":   cfg.Username,
+		"key_id":     cfg.Verification.KeyID,
+		"public_key": cfg.Verification.PublicKey,
+		"algorithm":  cfg.Verification.Algorithm,
+		"scope":      cfg.Verification.Scope,
+		"demo_label": cfg.Demo.Label,
+		"demo_path":  cfg.Demo.Path,
+
+		"demo_fields": formatDemoFields(cfg.Demo.Fields),
+	} {
+		form.Set(name, value)
+	}
+
+	for name, value := range map[string]int64{
+		"min_delay_seconds":            cfg.Polling.MinDelaySeconds,
+		"max_delay_seconds":            cfg.Polling.MaxDelaySeconds,
+		"long_polling_timeout_seconds": cfg.Polling.LongPollingTimeoutSeconds,
+		"cache_size":                   int64(cfg.Cache.Size),
+	} {
+		if value != 0 {
+			form.Set(name, strconv.FormatInt(value, 10))
+		}
+	}
+
+	return form
+}
@@ -2,17 +2,31 @@ package opa
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
-	"github.com/open-policy-agent/opa/sdk"
-
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
 	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
 )
 
+const (
+	// addWaitTimeout is how long the create form waits for a new OPA to
+	// activate its bundle before redirecting to it.
+	addWaitTimeout = 5 * time.Second
+
+	// updateTimeout is how long the edit form waits for the bundle of the
+	// new registration to be activated, the update is abandoned after it.
+	updateTimeout = 30 * time.Second
+)
+
 func NewOPACollectionHandler(opts *handlers.Options) (http.HandlerFunc, error) {
 	if opts == nil || opts.OPAManager == nil {
 		return nil, fmt.Errorf("opts and opa manager must be provided")
@@ -27,90 +41,146 @@ func NewOPACollectionHandler(opts *handlers.Options) (http.HandlerFunc, error) {
 		return nil, fmt.Errorf("failed to parse templates: %s", err)
 	}
 
+	// render writes the list page, form holds the values of a rejected
+	// create form to fill it with again along with the errors of its fields
+	render := func(w http.ResponseWriter, r *http.Request, status int, form url.Values, errs formErrors) {
+		csrfToken, err := handlers.CSRFToken(w, r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+
+		if form == nil {
+			form = url.Values{}
+		}
+
+		// secrets are not echoed back, so they must be entered again
+		for _, name := range []string{"token", "password", "verification_secret"} {
+			form.Del(name)
+		}
+
+		buf := bytes.NewBuffer([]byte{})
+
+		opas := opts.OPAManager.List()
+
+		err = tmpl.ExecuteTemplate(buf, "base", struct {
+			Opts      *handlers.Options
+			OPAs      []string
+			CSRFToken string
+			Form      url.Values
+			Errors    formErrors
+		}{
+			Opts:      opts,
+			OPAs:      opas,
+			CSRFToken: csrfToken,
+			Form:      form,
+			Errors:    errs,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(status)
+		_, err = io.Copy(w, buf)
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		var err error
+		if r.Method != http.MethodPost {
+			render(w, r, http.StatusOK, nil, nil)
+			return
+		}
 
-		if r.Method == http.MethodPost {
-			err = r.ParseForm()
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				_, err = w.Write([]byte(err.Error()))
-				return
-			}
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+
+		ref := strings.TrimSpace(r.PostFormValue("ref"))
 
-			ref := r.PostFormValue("ref")
+		if r.Form.Get("_method") == "DELETE" {
 			if ref == "" {
 				w.WriteHeader(http.StatusBadRequest)
 				_, err = w.Write([]byte("ref must be provided"))
 				return
 			}
 
-			if r.Form.Get("_method") == "DELETE" {
-				opts.OPAManager.Delete(r.Context(), ref)
-				http.Redirect(w, r, "/opas", http.StatusSeeOther)
+			err = opts.OPAManager.Delete(r.Context(), ref)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, err = w.Write([]byte(err.Error()))
 				return
 			}
 
-			systemID := r.Form.Get("system_id")
-			if systemID == "" {
-				w.WriteHeader(http.StatusBadRequest)
-				_, err = w.Write([]byte("system_id must be provided"))
-				return
-			}
+			http.Redirect(w, r, "/opas", http.StatusSeeOther)
+			return
+		}
 
-			token := r.Form.Get("token")
-			if token == "" {
-				w.WriteHeader(http.StatusBadRequest)
-				_, err = w.Write([]byte("token must be provided"))
-				return
-			}
+		errs := formErrors{}
+		duplicate := false
 
-			endpoint := r.Form.Get("endpoint")
-			if endpoint == "" {
-				w.WriteHeader(http.StatusBadRequest)
-				_, err = w.Write([]byte("endpoint must be provided"))
-				return
-			}
+		err = config.ValidateRef(ref)
+		if err != nil {
+			errs.add("ref", "%s", err)
+		} else if opts.OPAManager.Config(ref) != nil {
+			errs.add("ref", "an OPA with ref %s already exists", ref)
+			duplicate = true
+		}
+
+		source, err := sourceFromForm(r.Form, config.Source{})
+		errs.merge(err)
 
-			err = opts.OPAManager.Add(
-				r.Context(),
-				ref,
-				systemID,
-				token,
-				endpoint,
-			)
+		if source.Kind == config.SourceKindFile && source.Path != "" {
+			err = config.ValidateFileSourcePath(opts.FileSourceRoot, source.Path)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				_, err = w.Write([]byte(err.Error()))
-				return
+				errs.add("path", "%s", err)
 			}
-
-			http.Redirect(w, r, fmt.Sprintf("/opas/%s", ref), http.StatusSeeOther)
 		}
 
-		buf := bytes.NewBuffer([]byte{})
+		demo, err := demoFromForm(r.Form)
+		errs.merge(err)
 
-		opas := opts.OPAManager.List()
+		cache, err := cacheFromForm(r.Form)
+		errs.merge(err)
 
-		err = tmpl.ExecuteTemplate(buf, "base", struct {
-			Opts *handlers.Options
-			OPAs []string
-		}{
-			Opts: opts,
-			OPAs: opas,
-		})
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, err = w.Write([]byte(err.Error()))
+		if len(errs) > 0 {
+			status := http.StatusBadRequest
+			if duplicate && len(errs) == 1 {
+				status = http.StatusConflict
+			}
+
+			render(w, r, status, r.PostForm, errs)
 			return
 		}
 
-		_, err = io.Copy(w, buf)
+		err = opts.OPAManager.Add(
+			r.Context(),
+			ref,
+			config.OPA{Source: source, Demo: demo, Cache: cache},
+			opa.WaitForActivation(addWaitTimeout),
+			opa.Persist(),
+		)
+		if errors.Is(err, opa.ErrAlreadyExists) {
+			render(w, r, http.StatusConflict, r.PostForm, formErrors{
+				"ref": fmt.Sprintf("an OPA with ref %s already exists", ref),
+			})
+			return
+		}
+		if errors.Is(err, opa.ErrInvalidConfig) {
+			render(w, r, http.StatusBadRequest, r.PostForm, formErrors{"": err.Error()})
+			return
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			_, err = w.Write([]byte(err.Error()))
 			return
 		}
+
+		http.Redirect(w, r, "/opas/"+url.PathEscape(ref), http.StatusSeeOther)
 	}, nil
 }
 
@@ -128,26 +198,52 @@ func NewOPAShowHandler(opts *handlers.Options) (http.HandlerFunc, error) {
 		return nil, fmt.Errorf("failed to parse templates: %s", err)
 	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		buf := bytes.NewBuffer([]byte{})
-
-		ref := strings.TrimPrefix(r.URL.Path, "/opas/")
+	// render writes the show page, form holds the values of a rejected edit
+	// form to fill it with again along with the errors of its fields
+	render := func(w http.ResponseWriter, r *http.Request, status int, ref string, form url.Values, errs formErrors) {
+		csrfToken, err := handlers.CSRFToken(w, r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
 
-		opa := opts.OPAManager.Get(ref)
-		if opa == nil {
+		cfg := opts.OPAManager.Config(ref)
+		opaStatus := opts.OPAManager.Status(ref)
+		if cfg == nil || opaStatus == nil {
 			w.WriteHeader(http.StatusNotFound)
 			_, err = w.Write([]byte("opa not found"))
 			return
 		}
 
+		if form == nil {
+			form = formFromConfig(*cfg)
+		}
+
+		// secrets are not echoed back, the current ones are kept when they
+		// are left blank
+		for _, name := range []string{"token", "password", "verification_secret"} {
+			form.Del(name)
+		}
+
+		buf := bytes.NewBuffer([]byte{})
+
 		err = tmpl.ExecuteTemplate(buf, "base", struct {
-			Opts *handlers.Options
-			OPA  *sdk.OPA
-			Ref  string
+			Opts      *handlers.Options
+			Config    *config.OPA
+			Status    *opa.Status
+			Ref       string
+			CSRFToken string
+			Form      url.Values
+			Errors    formErrors
 		}{
-			Opts: opts,
-			OPA:  opa,
-			Ref:  ref,
+			Opts:      opts,
+			Config:    cfg,
+			Status:    opaStatus,
+			Ref:       ref,
+			CSRFToken: csrfToken,
+			Form:      form,
+			Errors:    errs,
 		})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -155,11 +251,114 @@ func NewOPAShowHandler(opts *handlers.Options) (http.HandlerFunc, error) {
 			return
 		}
 
+		w.WriteHeader(status)
 		_, err = io.Copy(w, buf)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := strings.TrimPrefix(r.URL.Path, "/opas/")
+
+		if r.Method != http.MethodPost {
+			render(w, r, http.StatusOK, ref, nil, nil)
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+
+		cfg := opts.OPAManager.Config(ref)
+		if cfg == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, err = w.Write([]byte("opa not found"))
+			return
+		}
+
+		if r.Form.Get("_method") != "PUT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			_, err = w.Write([]byte("method not allowed"))
+			return
+		}
+
+		errs := formErrors{}
+
+		updated := *cfg
+		updated.Source, err = sourceFromForm(r.Form, cfg.Source)
+		errs.merge(err)
+
+		updated.Demo, err = demoFromForm(r.Form)
+		errs.merge(err)
+
+		updated.Cache, err = cacheFromForm(r.Form)
+		errs.merge(err)
+
+		if len(errs) == 0 {
+			// the decision log settings are kept from cfg, so only the
+			// path of a file source can be rejected here
+			err = updated.ValidateRuntime(*cfg, opts.FileSourceRoot)
+			if err != nil {
+				errs.add("path", "%s", err)
+			}
+		}
+
+		if len(errs) > 0 {
+			render(w, r, http.StatusBadRequest, ref, r.PostForm, errs)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), updateTimeout)
+		defer cancel()
+
+		err = opts.OPAManager.Update(ctx, ref, updated)
+		if errors.Is(err, opa.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+		if errors.Is(err, opa.ErrInvalidConfig) {
+			render(w, r, http.StatusBadRequest, ref, r.PostForm, formErrors{"": err.Error()})
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			render(w, r, http.StatusGatewayTimeout, ref, r.PostForm, formErrors{"": fmt.Sprintf(
+				"the bundles of the new config were not activated within %s, check the endpoint and token. The previous config is still in use",
+				updateTimeout,
+			)})
+			return
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			_, err = w.Write([]byte(err.Error()))
 			return
 		}
+
+		http.Redirect(w, r, "/opas/"+url.PathEscape(ref), http.StatusSeeOther)
+	}, nil
+}
+
+func NewOPARefreshHandler(opts *handlers.Options) (http.HandlerFunc, error) {
+	if opts == nil || opts.OPAManager == nil {
+		return nil, fmt.Errorf("opts and opa manager must be provided")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.PathValue("ref")
+
+		err := opts.OPAManager.Refresh(r.Context(), ref)
+		if errors.Is(err, opa.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, err = w.Write([]byte(err.Error()))
+			return
+		}
+
+		http.Redirect(w, r, "/opas/"+url.PathEscape(ref), http.StatusSeeOther)
 	}, nil
 }
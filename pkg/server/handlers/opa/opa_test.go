@@ -12,8 +12,10 @@ import (
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/sdk"
 
 	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
 	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
 )
 
@@ -83,6 +85,183 @@ default allow := true`
 	}
 }
 
+func TestCreateOPAHTTPSource(t *testing.T) {
+	var err error
+
+	modulePath := "policy/allow.rego"
+	example1Mod := `package policy
+default allow := true`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(example1Mod),
+				Raw:    []byte(example1Mod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bundles/example.tar.gz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+
+		w.Header().Set("etag", exampleBundle.Manifest.Revision)
+		err = bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	m := opa.NewManager()
+	h, err := NewOPACollectionHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating OPA list handler: %s", err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	p := url.Values{}
+	p.Add("ref", "static-bundle")
+	p.Add("kind", "http")
+	p.Add("resource", "/bundles/example.tar.gz")
+	p.Add("endpoint", testServer.URL)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(p.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Log(rr.Body.String())
+		t.Fatalf("unexpected status code: %d", rr.Code)
+	}
+
+	if m.Get("static-bundle") == nil {
+		t.Fatalf("expected static-bundle to be registered")
+	}
+}
+
+func TestCreateOPAInvalid(t *testing.T) {
+	m := opa.NewManager()
+	err := m.Add(
+		context.Background(),
+		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: "127.0.0.1:1",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	h, err := NewOPACollectionHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating OPA list handler: %s", err)
+	}
+
+	testCases := map[string]struct {
+		fields         map[string]string
+		expectedStatus int
+		expectedBody   []string
+	}{
+		"invalid ref": {
+			fields:         map[string]string{"ref": "Example_1"},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody: []string{
+				"ref must only contain lowercase letters",
+				`value="Example_1"`,
+				`value="example2"`,
+			},
+		},
+		"invalid system id": {
+			fields:         map[string]string{"system_id": "example/2"},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"system_id must only contain letters"},
+		},
+		"invalid endpoint scheme": {
+			fields:         map[string]string{"endpoint": "ftp://example.com"},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   []string{"endpoint must use the http or https scheme", `value="ftp://example.com"`},
+		},
+		"duplicate ref": {
+			fields:         map[string]string{"ref": "example1"},
+			expectedStatus: http.StatusConflict,
+			expectedBody:   []string{"an OPA with ref example1 already exists"},
+		},
+		"several invalid fields": {
+			fields:         map[string]string{"ref": "", "kind": "http", "trigger": "manual"},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody: []string{
+				"ref must be provided",
+				"resource must be provided",
+				`<option value="http" selected>`,
+				`<option value="manual" selected>`,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			p := url.Values{}
+			p.Set("ref", "example2")
+			p.Set("system_id", "example2")
+			p.Set("token", "example2-token")
+			p.Set("endpoint", "127.0.0.1:1")
+			for k, v := range tc.fields {
+				p.Set(k, v)
+			}
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/", strings.NewReader(p.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			h.ServeHTTP(rr, req)
+
+			body := rr.Body.String()
+
+			if rr.Code != tc.expectedStatus {
+				t.Log(body)
+				t.Fatalf("unexpected status code: %d", rr.Code)
+			}
+
+			for _, s := range tc.expectedBody {
+				if !strings.Contains(body, s) {
+					t.Log(body)
+					t.Fatalf("expected %q to be present", s)
+				}
+			}
+
+			// secrets are not echoed back to the form
+			if strings.Contains(body, "example2-token") {
+				t.Fatalf("expected the token not to be present")
+			}
+
+			if len(m.List()) != 1 {
+				t.Fatalf("expected no OPA to be added")
+			}
+		})
+	}
+}
+
 func TestListOPAs(t *testing.T) {
 	var err error
 
@@ -126,9 +305,13 @@ default allow := true`
 	err = m.Add(
 		ctx,
 		"example1",
-		"example1",
-		"example1-token",
-		testServer.Listener.Addr().String(),
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.Listener.Addr().String(),
+			},
+		},
 	)
 	if err != nil {
 		t.Fatalf("unexpected error adding OPA: %s", err)
@@ -137,9 +320,13 @@ default allow := true`
 	err = m.Add(
 		ctx,
 		"example2",
-		"example2",
-		"example2-token",
-		testServer.Listener.Addr().String(),
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example2",
+				Token:    "example2-token",
+				Endpoint: testServer.Listener.Addr().String(),
+			},
+		},
 	)
 	if err != nil {
 		t.Fatalf("unexpected error adding OPA: %s", err)
@@ -221,9 +408,122 @@ default allow := true`
 	err = m.Add(
 		ctx,
 		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.Listener.Addr().String(),
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	h, err := NewOPAShowHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating OPA show handler: %s", err)
+	}
+
+	retries := 10
+	var bodyString string
+	for {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/opas/example1", nil)
+		h.ServeHTTP(rr, req)
+
+		bs, err := io.ReadAll(rr.Body)
+		if err != nil {
+			t.Fatalf("unexpected error reading response body: %s", err)
+		}
+
+		if rr.Code != http.StatusOK {
+			t.Log(string(bs))
+			t.Fatalf("unexpected status code: %d", rr.Code)
+		}
+
+		bodyString = string(bs)
+
+		if strings.Contains(bodyString, "systems/example1") {
+			break
+		}
+
+		retries--
+		if retries == 0 {
+			t.Fatalf("expected bundle status to be present")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if !strings.Contains(bodyString, "example1") {
+		t.Fatalf("expected example1 to be present")
+	}
+
+	if !strings.Contains(bodyString, "Delete") {
+		t.Fatalf("expected delete button to be present")
+	}
+
+	if strings.Count(bodyString, `name="csrf_token"`) != 3 {
+		t.Fatalf("expected each form to have a csrf token")
+	}
+}
+
+func TestUpdateOPA(t *testing.T) {
+	var err error
+
+	modulePath := "policy/allow.rego"
+	example1Mod := `package policy
+default allow := true`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(example1Mod),
+				Raw:    []byte(example1Mod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer example1-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+
+		w.Header().Set("etag", exampleBundle.Manifest.Revision)
+		err = bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	m := opa.NewManager()
+	err = m.Add(
+		ctx,
 		"example1",
-		"example1-token",
-		testServer.Listener.Addr().String(),
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.Listener.Addr().String(),
+			},
+		},
 	)
 	if err != nil {
 		t.Fatalf("unexpected error adding OPA: %s", err)
@@ -236,27 +536,319 @@ default allow := true`
 		t.Fatalf("unexpected error creating OPA show handler: %s", err)
 	}
 
+	p := url.Values{}
+	p.Add("_method", "PUT")
+	p.Add("kind", "das")
+	p.Add("system_id", "example2")
+	p.Add("endpoint", testServer.Listener.Addr().String())
+	p.Add("cache_size", "5")
+
 	rr := httptest.NewRecorder()
-	req := httptest.NewRequest("GET", "/opas/example1", nil)
+	req := httptest.NewRequest("POST", "/opas/example1", strings.NewReader(p.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	h.ServeHTTP(rr, req)
 
-	bs, err := io.ReadAll(rr.Body)
+	if rr.Code != http.StatusSeeOther {
+		t.Log(rr.Body.String())
+		t.Fatalf("unexpected status code: %d", rr.Code)
+	}
+
+	if rr.Header().Get("Location") != "/opas/example1" {
+		t.Fatalf("unexpected location header: %s", rr.Header().Get("Location"))
+	}
+
+	cfg := m.Config("example1")
+	if cfg.SystemID != "example2" {
+		t.Fatalf("unexpected system id after update: %s", cfg.SystemID)
+	}
+
+	if cfg.Token != "example1-token" {
+		t.Fatalf("expected token to be kept when left blank, got %s", cfg.Token)
+	}
+
+	if cfg.Cache.Size != 5 {
+		t.Fatalf("unexpected cache size after update: %d", cfg.Cache.Size)
+	}
+}
+
+func TestUpdateOPAInvalid(t *testing.T) {
+	m := opa.NewManager()
+	err := m.Add(
+		context.Background(),
+		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: "127.0.0.1:1",
+			},
+		},
+	)
 	if err != nil {
-		t.Fatalf("unexpected error reading response body: %s", err)
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	h, err := NewOPAShowHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating OPA show handler: %s", err)
+	}
+
+	testCases := map[string]struct {
+		fields       map[string]string
+		expectedBody []string
+	}{
+		"invalid system id": {
+			fields:       map[string]string{"system_id": "example/2"},
+			expectedBody: []string{"system_id must only contain letters", `value="example/2"`},
+		},
+		"invalid endpoint scheme": {
+			fields:       map[string]string{"endpoint": "ftp://example.com"},
+			expectedBody: []string{"endpoint must use the http or https scheme", `value="ftp://example.com"`},
+		},
+		"several invalid fields": {
+			fields: map[string]string{"kind": "http", "trigger": "manual", "cache_size": "-1"},
+			expectedBody: []string{
+				"resource must be provided",
+				"cache_size must be a positive number of decisions",
+				`<option value="http" selected>`,
+				`<option value="manual" selected>`,
+			},
+		},
+		"file source": {
+			fields:       map[string]string{"kind": "file", "path": "/etc"},
+			expectedBody: []string{"file sources may only be used in the config file", `value="/etc"`},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			p := url.Values{}
+			p.Set("_method", "PUT")
+			p.Set("kind", "das")
+			p.Set("system_id", "example2")
+			p.Set("token", "example2-token")
+			p.Set("endpoint", "127.0.0.1:1")
+			for k, v := range tc.fields {
+				p.Set(k, v)
+			}
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/opas/example1", strings.NewReader(p.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			h.ServeHTTP(rr, req)
+
+			body := rr.Body.String()
+
+			if rr.Code != http.StatusBadRequest {
+				t.Log(body)
+				t.Fatalf("unexpected status code: %d", rr.Code)
+			}
+
+			for _, s := range tc.expectedBody {
+				if !strings.Contains(body, s) {
+					t.Log(body)
+					t.Fatalf("expected %q to be present", s)
+				}
+			}
+
+			// secrets are not echoed back to the form
+			if strings.Contains(body, "example2-token") {
+				t.Fatalf("expected the token not to be present")
+			}
+
+			if m.Config("example1").SystemID != "example1" {
+				t.Fatalf("expected the OPA not to be updated")
+			}
+		})
+	}
+}
+
+func TestShowOPACache(t *testing.T) {
+	modulePath := "policy/allow.rego"
+	mod := `package policy
+default allow := true`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(mod),
+				Raw:    []byte(mod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	ctx := context.Background()
+
+	m := opa.NewManager()
+	err := m.Add(
+		ctx,
+		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.URL,
+			},
+			Cache: config.Cache{Size: 5},
+		},
+		opa.WaitForActivation(5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+	defer m.Delete(ctx, "example1")
+
+	for i := 0; i < 2; i++ {
+		_, err = m.Decision(ctx, "example1", sdk.DecisionOptions{Path: "/policy/allow"})
+		if err != nil {
+			t.Fatalf("unexpected error making decision: %s", err)
+		}
 	}
 
+	h, err := NewOPAShowHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating OPA show handler: %s", err)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/opas/example1", nil)
+	h.ServeHTTP(rr, req)
+
 	if rr.Code != http.StatusOK {
-		t.Log(string(bs))
+		t.Log(rr.Body.String())
 		t.Fatalf("unexpected status code: %d", rr.Code)
 	}
 
-	bodyString := string(bs)
+	for _, s := range []string{
+		"Decision cache",
+		"<td>1 of 5</td>",
+		"<td>0.50</td>",
+		`name="cache_size" class="form-control" value="5"`,
+	} {
+		if !strings.Contains(rr.Body.String(), s) {
+			t.Log(rr.Body.String())
+			t.Fatalf("expected %q to be present", s)
+		}
+	}
+}
 
-	if !strings.Contains(bodyString, "example1") {
-		t.Fatalf("expected example1 to be present")
+func TestRefreshOPA(t *testing.T) {
+	var err error
+
+	modulePath := "policy/allow.rego"
+	example1Mod := `package policy
+default allow := true`
+
+	exampleBundle := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(example1Mod),
+				Raw:    []byte(example1Mod),
+			},
+		},
 	}
 
-	if !strings.Contains(bodyString, "Delete") {
-		t.Fatalf("expected delete button to be present")
+	requests := make(chan struct{}, 10)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+
+		w.Header().Set("etag", exampleBundle.Manifest.Revision)
+		err = bundle.NewWriter(w).Write(*exampleBundle)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	m := opa.NewManager()
+	err = m.Add(
+		ctx,
+		"example1",
+		config.OPA{
+			Source: config.Source{
+				SystemID: "example1",
+				Token:    "example1-token",
+				Endpoint: testServer.Listener.Addr().String(),
+				Trigger:  config.TriggerManual,
+			},
+		},
+		opa.WaitForActivation(2*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error adding OPA: %s", err)
+	}
+
+	<-requests
+
+	h, err := NewOPARefreshHandler(&handlers.Options{
+		OPAManager: m,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating OPA refresh handler: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /opas/{ref}/refresh", h)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/opas/example1/refresh", nil)
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Log(rr.Body.String())
+		t.Fatalf("unexpected status code: %d", rr.Code)
+	}
+
+	if rr.Header().Get("Location") != "/opas/example1" {
+		t.Fatalf("unexpected location header: %s", rr.Header().Get("Location"))
+	}
+
+	select {
+	case <-requests:
+	default:
+		t.Fatalf("expected refresh to download the bundle")
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/opas/missing/refresh", nil)
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code for missing OPA: %d", rr.Code)
 	}
 }
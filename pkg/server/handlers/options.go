@@ -1,10 +1,27 @@
 package handlers
 
-import "github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
+)
 
 type Options struct {
 	OPAManager *opa.Manager
 
+	// Metrics is the registry served at /metrics, a new registry is used
+	// when it is not set.
+	Metrics *prometheus.Registry
+
+	// Auth configures authentication of the admin routes, all routes are
+	// public when it is empty.
+	Auth config.Auth
+
+	// FileSourceRoot is the directory file sources registered at runtime
+	// must be within, see config.ValidateFileSourcePath.
+	FileSourceRoot string
+
 	DevMode bool
 
 	EtagScript string
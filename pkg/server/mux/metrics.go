@@ -0,0 +1,51 @@
+package mux
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// httpMetrics are recorded for the requests to each route of the mux.
+type httpMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newHTTPMetrics(reg prometheus.Registerer) (*httpMetrics, error) {
+	m := &httpMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests by route, method and status code.",
+		}, []string{"handler", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time taken to serve HTTP requests by route and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"handler", "method"}),
+	}
+
+	for _, c := range []prometheus.Collector{m.requests, m.duration} {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// instrument records the metrics of the requests served by h under the
+// pattern it is registered with.
+func (m *httpMetrics) instrument(pattern string, h http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": pattern}
+
+	return promhttp.InstrumentHandlerCounter(
+		m.requests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(
+			m.duration.MustCurryWith(labels),
+			h,
+		),
+	)
+}
@@ -4,7 +4,13 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/auth"
 	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers/api"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers/compare"
 	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers/demo"
 	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers/index"
 	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers/opa"
@@ -15,6 +21,52 @@ func NewMux(opts *handlers.Options) (*http.ServeMux, error) {
 
 	mux := http.NewServeMux()
 
+	if opts.Metrics == nil {
+		opts.Metrics = prometheus.NewRegistry()
+	}
+
+	metrics, err := newHTTPMetrics(opts.Metrics)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register http metrics: %s", err)
+	}
+
+	// handle registers h for pattern, recording metrics for its requests
+	handle := func(pattern string, h http.Handler) {
+		mux.Handle(pattern, metrics.instrument(pattern, h))
+	}
+
+	authenticator, err := auth.New(opts.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build authenticator: %s", err)
+	}
+
+	// admin registers h for pattern, requiring requests to be authenticated
+	// when authentication is configured
+	admin := func(pattern string, h http.Handler) {
+		handle(pattern, authenticator.Middleware(h))
+	}
+
+	csrf, err := handlers.NewCSRFMiddleware(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build csrf middleware: %s", err)
+	}
+
+	// form registers the admin pages with forms, which verify the CSRF token
+	// of submitted forms
+	form := func(pattern string, h http.Handler) {
+		admin(pattern, csrf(h))
+	}
+
+	// demo registers the demo pages, which are public unless configured
+	// otherwise
+	demoAuthenticator := authenticator
+	if !opts.Auth.ProtectDemo {
+		demoAuthenticator = nil
+	}
+	demoHandle := func(pattern string, h http.Handler) {
+		handle(pattern, demoAuthenticator.Middleware(h))
+	}
+
 	stylesEtag, stylesHandler, err := static.BuildCSSHandler(opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build styles handler: %s", err)
@@ -28,30 +80,118 @@ func NewMux(opts *handlers.Options) (*http.ServeMux, error) {
 	opts.EtagStyles = stylesEtag
 	opts.EtagScript = scriptETag
 
-	mux.Handle("/script.js", http.HandlerFunc(scriptHandler))
-	mux.Handle("/styles.css", http.HandlerFunc(stylesHandler))
+	handle("/script.js", http.HandlerFunc(scriptHandler))
+	handle("/styles.css", http.HandlerFunc(stylesHandler))
 
 	osh, err := opa.NewOPAShowHandler(opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build opa show handler: %s", err)
 	}
-	mux.Handle("/opas/", osh)
+	form("/opas/", osh)
+
+	orh, err := opa.NewOPARefreshHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build opa refresh handler: %s", err)
+	}
+	form("POST /opas/{ref}/refresh", orh)
+
+	odh, err := opa.NewOPADecisionsHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build opa decisions handler: %s", err)
+	}
+	admin("GET /opas/{ref}/decisions", odh)
 
 	och, err := opa.NewOPACollectionHandler(opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build opa list handler: %s", err)
 	}
-	mux.Handle("/opas", och)
+	form("/opas", och)
+
+	alh, err := api.NewListOPAsHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build api opa list handler: %s", err)
+	}
+	admin("GET /api/v1/opas", alh)
+
+	acrh, err := api.NewCreateOPAHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build api opa create handler: %s", err)
+	}
+	admin("POST /api/v1/opas", acrh)
+
+	agh, err := api.NewGetOPAHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build api opa get handler: %s", err)
+	}
+	admin("GET /api/v1/opas/{ref}", agh)
+
+	auh, err := api.NewUpdateOPAHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build api opa update handler: %s", err)
+	}
+	admin("PUT /api/v1/opas/{ref}", auh)
+
+	adeh, err := api.NewDeleteOPAHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build api opa delete handler: %s", err)
+	}
+	admin("DELETE /api/v1/opas/{ref}", adeh)
+
+	adh, err := api.NewDecisionHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build api decision handler: %s", err)
+	}
+	admin("POST /api/v1/opas/{ref}/decision/{path...}", adh)
+
+	abh, err := api.NewBatchDecisionHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build api batch handler: %s", err)
+	}
+	admin("POST /api/v1/opas/{ref}/batch", abh)
+
+	aph, err := api.NewPartialHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build api partial handler: %s", err)
+	}
+	admin("POST /api/v1/opas/{ref}/partial", aph)
+
+	ach, err := api.NewCompareHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build api compare handler: %s", err)
+	}
+	admin("POST /api/v1/compare", ach)
+
+	ch, err := compare.NewCompareHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build compare handler: %s", err)
+	}
+	admin("/compare", ch)
 
 	dh, err := demo.NewDemoHandler(opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build demo handler: %s", err)
 	}
 	if dh != nil {
-		mux.Handle("/demo/", dh)
+		demoHandle("/demo/", dh)
+	}
+
+	deh, err := demo.NewDemoEventsHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build demo events handler: %s", err)
 	}
+	demoHandle("GET /demo/{ref}/events", deh)
+
+	dfh, err := demo.NewDemoFilterHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build demo filter handler: %s", err)
+	}
+	// the filter page evaluates any query sent to it, so it can read all the
+	// data of the OPA and is not public like the other demo pages
+	admin("GET /demo/{ref}/filter", dfh)
+
+	admin("GET /metrics", promhttp.HandlerFor(opts.Metrics, promhttp.HandlerOpts{}))
 
-	mux.Handle("/", http.HandlerFunc(index.IndexHandler))
+	handle("/", http.HandlerFunc(index.IndexHandler))
 
 	return mux, nil
 }
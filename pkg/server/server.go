@@ -5,9 +5,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+
 	"github.com/charlieegan3/demo-live-policy-update/pkg/opa"
+	"github.com/charlieegan3/demo-live-policy-update/pkg/registry"
 	"github.com/charlieegan3/demo-live-policy-update/pkg/server/config"
 	"github.com/charlieegan3/demo-live-policy-update/pkg/server/handlers"
 	"github.com/charlieegan3/demo-live-policy-update/pkg/server/mux"
@@ -27,18 +32,44 @@ func NewServer(cfg *config.Config) (*Server, error) {
 func (s *Server) Start(ctx context.Context) error {
 	var err error
 
-	mgr := opa.NewManager()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	mgrOpts := []func(*opa.Manager){
+		opa.WithMetrics(reg),
+	}
+	if s.cfg.Registry.Path != "" {
+		store, err := newRegistryStore(s.cfg.Registry)
+		if err != nil {
+			return fmt.Errorf("failed to create registry store: %s", err)
+		}
+
+		mgrOpts = append(mgrOpts, opa.WithStore(store))
+	}
+
+	mgr := opa.NewManager(mgrOpts...)
 	if len(s.cfg.OPAs) > 0 {
 		for ref, o := range s.cfg.OPAs {
-			err = mgr.Add(ctx, ref, o.SystemID, o.Token, o.Endpoint)
+			err = mgr.Add(ctx, ref, o)
 			if err != nil {
 				return fmt.Errorf("failed to add opa %s: %s", ref, err)
 			}
 		}
 	}
 
+	err = mgr.Restore(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to restore opas: %s", err)
+	}
+
 	opts := &handlers.Options{
-		OPAManager: mgr,
+		OPAManager:     mgr,
+		Metrics:        reg,
+		Auth:           s.cfg.Auth,
+		FileSourceRoot: s.cfg.FileSourceRoot,
 	}
 
 	m, err := mux.NewMux(opts)
@@ -77,6 +108,20 @@ func (s *Server) Start(ctx context.Context) error {
 	return nil
 }
 
+func newRegistryStore(cfg config.Registry) (registry.Store, error) {
+	keyEnv := cfg.KeyEnv
+	if keyEnv == "" {
+		keyEnv = config.DefaultRegistryKeyEnv
+	}
+
+	key, err := registry.ParseKey(os.Getenv(keyEnv))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %s", keyEnv, err)
+	}
+
+	return registry.NewFileStore(cfg.Path, key)
+}
+
 func (s *Server) Stop(ctx context.Context) error {
 	if s.httpServer != nil {
 		err := s.httpServer.Shutdown(ctx)
@@ -3,8 +3,10 @@ package server
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -98,3 +100,233 @@ allow if input.name in {"alice", "bob", "charlie"}
 	}
 
 }
+
+func TestServerMetrics(t *testing.T) {
+	modulePath := "policy/allow.rego"
+
+	mod := `
+package policy
+
+import rego.v1
+
+allow if input.name in {"alice", "bob", "charlie"}
+`
+
+	b := &bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: "1",
+		},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    modulePath,
+				Path:   modulePath,
+				Parsed: ast.MustParseModule(mod),
+				Raw:    []byte(mod),
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
+		err := bundle.NewWriter(w).Write(*b)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handler))
+	defer testServer.Close()
+
+	port, err := utils.FreePort()
+	if err != nil {
+		t.Fatalf("unexpected error finding free port: %s", err)
+	}
+
+	serverConfig := &config.Config{
+		Port:    port,
+		Address: "localhost",
+		OPAs: map[string]config.OPA{
+			"example": {
+				Source: config.Source{
+					SystemID: "example",
+					Token:    "example-token",
+					Endpoint: testServer.URL,
+				},
+			},
+		},
+	}
+
+	svr, err := NewServer(serverConfig)
+	if err != nil {
+		t.Fatalf("unexpected error creating server: %s", err)
+	}
+
+	ctx := context.Background()
+
+	err = svr.Start(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting server: %s", err)
+	}
+	defer svr.Stop(ctx)
+
+	baseURL := fmt.Sprintf("http://%s:%d", serverConfig.Address, serverConfig.Port)
+
+	// the decision is retried until the server is listening and the bundle
+	// has been activated
+	retries := 50
+	for {
+		resp, err := http.Post(
+			baseURL+"/api/v1/opas/example/decision/policy/allow",
+			"application/json",
+			strings.NewReader(`{"input": {"name": "alice"}}`),
+		)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+
+		retries--
+		if retries == 0 {
+			t.Fatalf("unexpected error making decision after retries")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	resp, err := http.Get(baseURL + "/metrics")
+	if err != nil {
+		t.Fatalf("unexpected error getting metrics: %s", err)
+	}
+	defer resp.Body.Close()
+
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading metrics: %s", err)
+	}
+
+	for _, s := range []string{
+		`opa_manager_decisions_total{outcome="defined",ref="example"} 1`,
+		`opa_manager_decision_duration_seconds_count{ref="example"} 1`,
+		`opa_manager_bundle_downloads_total{bundle="systems/example",ref="example"}`,
+		`opa_manager_bundle_activations_total{bundle="systems/example",ref="example"}`,
+		`opa_manager_bundle_last_successful_activation_timestamp_seconds{bundle="systems/example",ref="example"}`,
+		`opa_manager_ready{ref="example"} 1`,
+		`http_requests_total{code="200",handler="POST /api/v1/opas/{ref}/decision/{path...}",method="post"} 1`,
+		`http_request_duration_seconds_count{handler="POST /api/v1/opas/{ref}/decision/{path...}",method="post"} 1`,
+	} {
+		if !strings.Contains(string(bs), s) {
+			t.Log(string(bs))
+			t.Fatalf("expected %q to be present", s)
+		}
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	port, err := utils.FreePort()
+	if err != nil {
+		t.Fatalf("unexpected error finding free port: %s", err)
+	}
+
+	serverConfig := &config.Config{
+		Port:    port,
+		Address: "localhost",
+		Auth: config.Auth{
+			Tokens: []string{"admin-token"},
+		},
+	}
+
+	svr, err := NewServer(serverConfig)
+	if err != nil {
+		t.Fatalf("unexpected error creating server: %s", err)
+	}
+
+	ctx := context.Background()
+
+	err = svr.Start(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting server: %s", err)
+	}
+	defer svr.Stop(ctx)
+
+	baseURL := fmt.Sprintf("http://%s:%d", serverConfig.Address, serverConfig.Port)
+
+	get := func(path, token string) int {
+		req, err := http.NewRequest(http.MethodGet, baseURL+path, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %s", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	// the request is retried until the server is listening
+	retries := 10
+	for get("/demo/", "") == 0 {
+		retries--
+		if retries == 0 {
+			t.Fatalf("unexpected error connecting to server after retries")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	testCases := map[string]struct {
+		path           string
+		token          string
+		expectedStatus int
+	}{
+		"admin without token": {
+			path:           "/opas",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		"admin with wrong token": {
+			path:           "/opas",
+			token:          "other-token",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		"admin with token": {
+			path:           "/opas",
+			token:          "admin-token",
+			expectedStatus: http.StatusOK,
+		},
+		"api without token": {
+			path:           "/api/v1/opas",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		"demo filter requires auth": {
+			// the filter page evaluates any query against the data of the OPA
+			path:           "/demo/example/filter",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		"demo is public": {
+			// there is no OPA to demo, but the request is not rejected
+			path:           "/demo/example",
+			expectedStatus: http.StatusNotFound,
+		},
+		"styles are public": {
+			path:           "/styles.css",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			status := get(tc.path, tc.token)
+			if status != tc.expectedStatus {
+				t.Fatalf("unexpected status code: %d", status)
+			}
+		})
+	}
+}